@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go/build"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hightech-ninja/valctx/valctxgen"
+)
+
+// target is a file generated by a //valctx:generate directive.
+type target struct {
+	// pos is the position of the directive.
+	pos    string
+	output string
+	// args are the directive flags, with the output relative to the working directory.
+	args []string
+}
+
+// findTargets returns the targets of the //valctx:generate directives in the Go files
+// matching the patterns, see walkGoFiles. Files excluded from the build by file names
+// or build constraints are skipped, and so are files matched by several patterns.
+// The flags are used to find the -output flag in the directive flags.
+func findTargets(flags *flag.FlagSet, patterns []string) ([]target, error) {
+	var (
+		targets []target
+		outputs = map[string]string{} // output to the position of its directive
+		seen    = map[string]bool{}
+	)
+	err := walkGoFiles(patterns, func(path string, found bool) error {
+		if seen[filepath.Clean(path)] {
+			return nil
+		}
+		seen[filepath.Clean(path)] = true
+		dir, name := filepath.Split(path)
+		if ok, err := build.Default.MatchFile(filepath.Clean(dir), name); err != nil || !ok {
+			return err
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		directives, err := valctxgen.ReadDirectives(path, src)
+		if err != nil {
+			return err
+		}
+		for _, d := range directives {
+			args, output := resolveOutput(flags, dir, d.Args)
+			if output == "" {
+				return fmt.Errorf("%s: output file is required", d.Pos)
+			}
+			if pos, ok := outputs[filepath.Clean(output)]; ok {
+				return fmt.Errorf("%s: %s is also generated by the directive at %s", d.Pos, output, pos)
+			}
+			outputs[filepath.Clean(output)] = d.Pos
+			targets = append(targets, target{pos: d.Pos, output: output, args: args})
+		}
+		return nil
+	})
+	return targets, err
+}
+
+// resolveOutput returns a copy of the args with the -output flag value relative to dir,
+// the directory of the directive, and the resulting output.
+// The args are scanned like the flags package parses them.
+func resolveOutput(flags *flag.FlagSet, dir string, args []string) ([]string, string) {
+	args = append([]string(nil), args...)
+	var output string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			break
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value, hasValue := "", false
+		if j := strings.Index(name, "="); j >= 0 {
+			name, value, hasValue = name[:j], name[j+1:], true
+		}
+		f := flags.Lookup(name)
+		if f == nil {
+			break
+		}
+		if b, ok := f.Value.(interface {
+			IsBoolFlag() bool
+		}); ok && b.IsBoolFlag() {
+			continue
+		}
+		if !hasValue {
+			if i+1 == len(args) {
+				break
+			}
+			i++
+			value = args[i]
+		}
+		if name != "output" || value == "" {
+			continue
+		}
+		output = value
+		if !filepath.IsAbs(output) {
+			output = filepath.Join(dir, output)
+		}
+		if hasValue {
+			args[i] = "-output=" + output
+		} else {
+			args[i] = output
+		}
+	}
+	return args, output
+}
+
+// errReported is the error of targets with invalid flags or fields, reported in the output.
+var errReported = errors.New("invalid directive")
+
+// targetResult is the outcome of generating a target.
+type targetResult struct {
+	done    bool
+	changed bool
+	err     error
+	// out is the output of the generation: diagnostics and warnings.
+	out bytes.Buffer
+}
+
+// runTargets generates the targets with jobs workers running the command with the target args,
+// then prints the status of each target and a summary. Outputs are written only if they change.
+// The targets not started before the context is done are skipped: they are reported apart
+// from the failed ones, and the returned error is the context error.
+func runTargets(
+	ctx context.Context,
+	targets []target,
+	jobs int,
+	stdout, stderr io.Writer,
+	runTarget func(args []string, out io.Writer, openFile func(name string) (io.WriteCloser, error)) (int, error),
+	openFile func(name string) (io.WriteCloser, error),
+) (int, error) {
+	if len(targets) == 0 {
+		_, _ = fmt.Fprintln(stderr, "warning: no //valctx:generate directives found")
+		return 0, nil
+	}
+	results := make([]targetResult, len(targets))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				if ctx.Err() != nil {
+					continue
+				}
+				r := &results[i]
+				file := &outputFile{openFile: openFile}
+				code, err := runTarget(targets[i].args, &r.out, file.open)
+				if code != 0 && err == nil {
+					err = errReported
+				}
+				r.done, r.changed, r.err = true, file.changed, err
+			}
+		}()
+	}
+feed:
+	for i := range targets {
+		select {
+		case queue <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	var changed, unchanged, failed, skipped int
+	for i, t := range targets {
+		r := &results[i]
+		status := "unchanged"
+		switch {
+		case !r.done:
+			status = "skipped"
+			skipped++
+		case r.err != nil:
+			status = "failed"
+			failed++
+		case r.changed:
+			status = "changed"
+			changed++
+		default:
+			unchanged++
+		}
+		_, _ = fmt.Fprintf(stdout, "%-9s %s\n", status, t.output)
+		scanner := bufio.NewScanner(&r.out)
+		for scanner.Scan() {
+			_, _ = fmt.Fprintf(stderr, "%s: %s\n", t.pos, scanner.Text())
+		}
+		if r.err != nil && r.err != errReported {
+			_, _ = fmt.Fprintf(stderr, "%s: %v\n", t.pos, r.err)
+		}
+	}
+	summary := fmt.Sprintf("%d changed, %d unchanged, %d failed", changed, unchanged, failed)
+	if skipped > 0 {
+		summary += fmt.Sprintf(", %d skipped", skipped)
+	}
+	_, _ = fmt.Fprintln(stdout, summary)
+	switch {
+	case failed > 0:
+		return 1, fmt.Errorf("%d of %d outputs failed", failed, len(targets))
+	case skipped > 0:
+		return 1, fmt.Errorf("%d of %d outputs skipped: %v", skipped, len(targets), ctx.Err())
+	}
+	return 0, nil
+}
+
+// renamer is implemented by files written to the output on Close only if WithRename
+// was called, see app.SafeFile.
+type renamer interface {
+	WithRename()
+}
+
+// outputFile buffers the source generated for a target, and writes it to the output file
+// on Close only if it differs from the existing content, leaving unchanged files untouched.
+type outputFile struct {
+	name     string
+	openFile func(name string) (io.WriteCloser, error)
+	buf      bytes.Buffer
+	rename   bool
+	// changed reports whether the output file was written.
+	changed bool
+}
+
+func (f *outputFile) open(name string) (io.WriteCloser, error) {
+	f.name = name
+	return f, nil
+}
+
+func (f *outputFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *outputFile) WithRename() {
+	f.rename = true
+}
+
+func (f *outputFile) Close() error {
+	if !f.rename {
+		return nil
+	}
+	if existing, err := ioutil.ReadFile(f.name); err == nil && bytes.Equal(existing, f.buf.Bytes()) {
+		return nil
+	}
+	file, err := f.openFile(f.name)
+	if err != nil {
+		return fmt.Errorf("open file: %v", err)
+	}
+	if _, err = file.Write(f.buf.Bytes()); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("write file: %v", err)
+	}
+	if r, ok := file.(renamer); ok {
+		r.WithRename()
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	f.changed = true
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import "runtime/debug"
+
+// readBuildInfo returns the module version and the VCS revision and time
+// recorded in the binary by the go command.
+func readBuildInfo() (version, commitHash, buildDate string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", "", ""
+	}
+	if info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			commitHash = s.Value
+		case "vcs.time":
+			buildDate = s.Value
+		}
+	}
+	return version, commitHash, buildDate
+}
@@ -0,0 +1,9 @@
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+// readBuildInfo returns no build info: the VCS settings are recorded in binaries since Go 1.18.
+func readBuildInfo() (version, commitHash, buildDate string) {
+	return "", "", ""
+}
@@ -2,13 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/hightech-ninja/valctx/internal/app"
-	"github.com/hightech-ninja/valctx/internal/gen"
+	"github.com/hightech-ninja/valctx/valctxgen"
 )
 
 // Version, CommitHash, BuildDate are set with ldflags.
@@ -21,10 +28,22 @@ var (
 func main() {
 	ctx, cancel := app.NotifyContext(context.Background(), os.Interrupt, os.Kill)
 	defer cancel()
+	version, commitHash, buildDate := Version, CommitHash, BuildDate
+	// Binaries built with go install have no ldflags, but the module build info.
+	infoVersion, infoCommitHash, infoBuildDate := readBuildInfo()
+	if version == "latest" && infoVersion != "" {
+		version = infoVersion
+	}
+	if commitHash == "main" && infoCommitHash != "" {
+		commitHash = infoCommitHash
+	}
+	if buildDate == "unknown" && infoBuildDate != "" {
+		buildDate = infoBuildDate
+	}
 	code, err := run(
 		ctx,
 		os.Args[1:], os.Stdout, os.Stderr,
-		Version, CommitHash, BuildDate,
+		version, commitHash, buildDate,
 		app.NewSafeFile,
 	)
 	if err != nil {
@@ -42,12 +61,31 @@ func run(
 	version, commitHash, buildDate string,
 	openFile func(name string) (io.WriteCloser, error),
 ) (int, error) {
-	generate := func(
-		outFile string,
-		pkg gen.Package,
-		fs []gen.Field,
-	) (err error) {
-		file, err := openFile(outFile)
+	return runCmd(ctx, args, stdout, stderr, version, commitHash, buildDate, openFile, true)
+}
+
+// runCmd runs the command with the args, printUsage is false for the commands
+// of //valctx:generate directives, reporting problems without the usage.
+func runCmd(
+	ctx context.Context,
+	args []string,
+	stdout, stderr io.Writer,
+	version, commitHash, buildDate string,
+	openFile func(name string) (io.WriteCloser, error),
+	printUsage bool,
+) (int, error) {
+	generate := func(spec valctxgen.Spec) (err error) {
+		src, err := valctxgen.Generate(ctx, spec)
+		if unchecked, ok := err.(*valctxgen.UncheckedError); ok {
+			_, _ = fmt.Fprintf(stderr, "warning: %v\n", unchecked)
+			err = nil
+		}
+		if _, invalid := err.(valctxgen.Errors); invalid {
+			return err
+		} else if err != nil {
+			return fmt.Errorf("generate: %v", err)
+		}
+		file, err := openFile(spec.Output)
 		if err != nil {
 			return fmt.Errorf("open file: %v", err)
 		}
@@ -58,12 +96,9 @@ func run(
 				err = fmt.Errorf("%v; %v", err, closeErr)
 			}
 		}()
-		err = gen.Generate(ctx, file, pkg, fs)
+		_, err = file.Write(src)
 		if err != nil {
-			return fmt.Errorf("generate: %v", err)
-		}
-		type renamer interface {
-			WithRename()
+			return fmt.Errorf("write file: %v", err)
 		}
 		if r, ok := file.(renamer); ok {
 			r.WithRename()
@@ -74,39 +109,156 @@ func run(
 	versionCmd := flag.NewFlagSet("version", flag.ContinueOnError)
 	versionCmd.SetOutput(stderr)
 	versionCmd.Usage = func() {
-		_, _ = fmt.Fprintln(stderr, "Usage: valctx version")
+		_, _ = fmt.Fprintln(stderr, "Usage: valctx version [flags]")
 		versionCmd.PrintDefaults()
 	}
+	versionJSON := versionCmd.Bool("json", false, "Print the version as a JSON object with version, commitHash and buildDate keys.")
+
+	regenCmd := flag.NewFlagSet("regen", flag.ContinueOnError)
+	regenCmd.SetOutput(stderr)
+	regenCmd.Usage = func() {
+		_, _ = fmt.Fprintln(stderr, "Usage: valctx regen <file.go|dir|dir/...>...")
+		_, _ = fmt.Fprintln(stderr, "Regen regenerates files with the valctx command recorded in their header, by the current valctx version.\n"+
+			"Directories are searched for files generated by valctx, dir/... searches the whole tree.")
+		regenCmd.PrintDefaults()
+	}
+	regenStrictVersion := regenCmd.Bool("strict-version", false, "Fail instead of warning if a file was generated by a newer valctx version.")
 
 	rootCmd := flag.NewFlagSet("", flag.ContinueOnError)
 	rootCmd.SetOutput(stderr)
 	rootCmd.Usage = func() {
-		_, _ = fmt.Fprintln(stderr, "\nUsage: valctx [flags]")
-		_, _ = fmt.Fprintln(stderr, "Valctx is a tool to generate convenient setters and getters for context values.")
+		if !printUsage {
+			return
+		}
+		_, _ = fmt.Fprintln(stderr, "\nUsage: valctx [flags]\n       valctx [-jobs n] [-strict-version] <file.go|dir|dir/...>...\n"+
+			"       valctx regen <file.go|dir|dir/...>...\n       valctx version")
+		_, _ = fmt.Fprintln(stderr, "Valctx is a tool to generate convenient setters and getters for context values.\n"+
+			"Given files or directories, valctx generates the files of the //valctx:generate directives found in the Go files,\n"+
+			"dir/... searches the whole tree.")
 		rootCmd.PrintDefaults()
 	}
 	var (
-		output string
-		pkg    string
-		fields app.FieldFlags
+		spec          = valctxgen.Spec{Version: version}
+		fields        fieldFlags
+		diagnostics   string
+		strictVersion bool
+		merge         bool
+		jobs          int
 	)
-	rootCmd.StringVar(&output, "output", "", "Output file.")
-	rootCmd.StringVar(&pkg, "package", "", "Package name for the generated file.")
+	rootCmd.StringVar(&spec.Output, "output", "", "Output file.")
+	rootCmd.StringVar(&spec.Package, "package", "", "Package name for the generated file.\n\t"+
+		"Defaults to the package of the Go files in the output directory, or to the directory name.")
+	rootCmd.StringVar(&spec.GoVersion, "go", "", "Go version targeted by the generated code, e.g. 1.21, 1.22rc1 or go1.22.0. Defaults to 1.7.\n\t"+
+		"Controls the language features and standard library functions the generated code uses.")
+	rootCmd.StringVar(&spec.NilIsAbsent, "nil-is-absent", "", "Apply the nil-is-absent option with the given value (get, drop or refuse)\n\t"+
+		"to all fields of nilable types without the option.")
+	rootCmd.BoolVar(&spec.RuntimeKeys, "runtime-keys", false, "Generate accessors wrapping exported keys of the github.com/hightech-ninja/valctx package.\n\t"+
+		"Fields can't have options other than lazy, mutable and append. Requires -go 1.18 or later.")
+	rootCmd.BoolVar(&spec.VerifyLocalTypes, "verify-local-types", false, "Check that local field types are declared in the output package.")
+	rootCmd.BoolVar(&spec.ScanFields, "scan-fields", false, "Add the fields declared with //valctx:field directives in the doc comments of types of the output package.\n\t"+
+		"The directive is followed by the field name, defaulting to the type name, and the field options, e.g. //valctx:field TenantID,set-once.")
+	rootCmd.BoolVar(&merge, "merge", false, "Merge the fields into the fields of the existing output file, keeping its recorded flags as defaults.\n\t"+
+		"A field replaces the existing field with the same name and type, conflicting types are reported.\n\t"+
+		"The merged fields are sorted by name.")
+	rootCmd.BoolVar(&strictVersion, "strict-version", false, "Fail instead of warning if the output file was generated by a newer valctx version.")
+	rootCmd.IntVar(&jobs, "jobs", runtime.NumCPU(), "Number of files generated in parallel for //valctx:generate directives.")
+	rootCmd.StringVar(&diagnostics, "diagnostics", "text", "Format of the reported problems of flags and fields: text or json.\n\t"+
+		"JSON diagnostics are printed to stdout as an array of objects with setting, index, field, pos and message keys,\n\t"+
+		"index is the index of the -field flag.")
 	rootCmd.Var(&fields, "field", "Context field in go-code format, but name and type separated with colon.\n\t"+
 		"All fields must have unique names. There are some limitations on allowed types.\n\t"+
-		"Examples:\n\t\t* UserID:int\n\t\t* Data:[]string\n\t\t* User:github.com/user/pkg.User")
+		"Field options follow the type, separated with commas:\n\t\t"+
+		"* renamed-from=Name: keep deprecated accessors of the former field name\n\t\t"+
+		"* set-once[=error|panic]: setter fails if the value is already set\n\t\t"+
+		"* copy[=set|get]: accessors of slice, map and pointer fields copy the value\n\t\t"+
+		"* lazy: value is computed by a loader on first access\n\t\t"+
+		"* mutable: value is updated in place in a holder installed once\n\t\t"+
+		"* append: field is a list of values of the type accumulated across contexts\n\t\t"+
+		"* closer: value implementing io.Closer is closed when the context is done\n\t\t"+
+		"* ttl: value may be set with a time-to-live\n\t\t"+
+		"* nil-is-absent[=get|drop|refuse]: getter reports nil as absent, setter keeps, ignores or refuses nil\n\t\t"+
+		"* validate=[module/path.]Func: setter checks the value with func(T) error\n\t\t"+
+		"* header=Name: generated FromHeader sets the string field from the HTTP header\n\t\t"+
+		"* required: FromHeader fails if the header is missing\n\t"+
+		"Use .Type format for types declared in the output package.\n\t"+
+		"Examples:\n\t\t* UserID:int\n\t\t* Data:[]string\n\t\t* User:github.com/user/pkg.User\n\t\t* Session:*.Session\n\t\t"+
+		"* Value:example.com/opt.Option[github.com/google/uuid.UUID] (with -go 1.18 or later)\n\t\t"+
+		"* TenantID:string,renamed-from=OrgID\n\t\t* TenantID:string,set-once\n\t\t* TraceIDs:[]string,copy\n\t\t"+
+		"* User:github.com/user/pkg.User,lazy\n\t\t* TenantID:string,required,header=X-Tenant")
 	validateRootCmdFlags := func() error {
-		if output == "" {
-			return fmt.Errorf("output file is required")
+		if diagnostics != "text" && diagnostics != "json" {
+			return fmt.Errorf("unsupported diagnostics format %q", diagnostics)
+		}
+		if spec.Output == "" {
+			return valctxgen.Errors{&valctxgen.SpecError{Setting: "Output", Err: errors.New("output file is required")}}
+		}
+		spec.RawFields = fields
+		return nil
+	}
+	// mergeExisting merges the -field flags into the fields of the existing output file.
+	// The flags recorded in the file are parsed first, so that explicit flags override them.
+	mergeExisting := func(args []string) error {
+		src, err := ioutil.ReadFile(spec.Output)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("merge: %v", err)
+		}
+		added, err := valctxgen.ParseFields(fields)
+		if err != nil {
+			return err
+		}
+		var existing []valctxgen.Field
+		recorded, err := valctxgen.ReadArgs(src)
+		switch err {
+		case nil:
+			fields = nil
+			if err = rootCmd.Parse(recorded); err != nil {
+				return fmt.Errorf("merge: %s: invalid recorded command: %v", spec.Output, err)
+			}
+			if existing, err = valctxgen.ParseFields(fields); err != nil {
+				return fmt.Errorf("merge: %s: invalid recorded command: %v", spec.Output, err)
+			}
+			fields = nil
+			if err = rootCmd.Parse(args); err != nil {
+				return err
+			}
+		case valctxgen.ErrNoCommand:
+			if existing, err = valctxgen.ReadFields(src); err != nil {
+				return fmt.Errorf("merge: %s: %v", spec.Output, err)
+			}
+		default:
+			return fmt.Errorf("merge: %s: %v", spec.Output, err)
 		}
-		if pkg == "" {
-			return fmt.Errorf("package name is required")
+		for i := range existing {
+			existing[i].Pos = spec.Output
 		}
-		if len(fields) == 0 {
-			return fmt.Errorf("at least one field is required")
+		for i := range added {
+			added[i].Pos = fmt.Sprintf("-field #%d", i+1)
+		}
+		merged, err := valctxgen.MergeFields(existing, added)
+		if err != nil {
+			return err
 		}
+		spec.Fields, fields = merged, nil
 		return nil
 	}
+	report := func(err error) (int, error) {
+		errs, invalid := err.(valctxgen.Errors)
+		switch {
+		case !invalid:
+			_, _ = fmt.Fprintf(stderr, "invalid flags: %v\n", err)
+		case diagnostics == "json":
+			if err = json.NewEncoder(stdout).Encode(valctxgen.Diagnostics(errs)); err != nil {
+				return 1, err
+			}
+			return 2, nil
+		default:
+			printDiagnostics(stderr, valctxgen.Diagnostics(errs))
+		}
+		rootCmd.Usage()
+		return 2, nil
+	}
 
 	var subCmd string
 	if len(args) > 0 {
@@ -118,24 +270,95 @@ func run(
 		if err := rootCmd.Parse(args); err != nil {
 			return 2, nil
 		}
+		if rootCmd.NArg() > 0 {
+			var flagErr error
+			rootCmd.Visit(func(f *flag.Flag) {
+				if f.Name != "jobs" && f.Name != "strict-version" && flagErr == nil {
+					flagErr = fmt.Errorf("flag -%s can't be used with files or directories, set it in the //valctx:generate directives", f.Name)
+				}
+			})
+			if flagErr == nil && jobs < 1 {
+				flagErr = fmt.Errorf("invalid number of jobs %d", jobs)
+			}
+			if flagErr != nil {
+				return report(flagErr)
+			}
+			targets, err := findTargets(rootCmd, rootCmd.Args())
+			if err != nil {
+				return 1, err
+			}
+			if strictVersion {
+				for i := range targets {
+					targets[i].args = append(targets[i].args, "-strict-version")
+				}
+			}
+			return runTargets(ctx, targets, jobs, stdout, stderr, func(args []string, out io.Writer, openFile func(string) (io.WriteCloser, error)) (int, error) {
+				return runCmd(ctx, args, out, out, version, commitHash, buildDate, openFile, false)
+			}, openFile)
+		}
+		if merge && spec.Output != "" {
+			if err := mergeExisting(args); err != nil {
+				if _, invalid := err.(valctxgen.Errors); invalid {
+					return report(err)
+				}
+				return 1, err
+			}
+		}
 		if err := validateRootCmdFlags(); err != nil {
-			_, _ = fmt.Fprintf(stderr, "invalid flags: %v\n", err)
-			rootCmd.Usage()
+			return report(err)
+		}
+		if err := checkOutputVersion(spec.Output, version); err != nil {
+			if strictVersion {
+				return 1, err
+			}
+			_, _ = fmt.Fprintf(stderr, "warning: %v\n", err)
+		}
+		if err := generate(spec); err != nil {
+			if _, invalid := err.(valctxgen.Errors); invalid {
+				return report(err)
+			}
+			return 1, err
+		}
+	case subCmd == "regen":
+		if err := regenCmd.Parse(args[1:]); err != nil {
 			return 2, nil
 		}
-		genPkg, genFields, err := app.ParseFields(pkg, version, fields)
-		if err != nil {
-			_, _ = fmt.Fprintf(stderr, "invalid fields: %v\n", err)
-			rootCmd.Usage()
+		if regenCmd.NArg() == 0 {
+			regenCmd.Usage()
 			return 2, nil
 		}
-		if err = generate(output, genPkg, genFields); err != nil {
+		files, err := findGeneratedFiles(regenCmd.Args())
+		if err != nil {
 			return 1, err
 		}
+		for _, f := range files {
+			args := append(f.args, "-output", f.path)
+			if *regenStrictVersion {
+				args = append(args, "-strict-version")
+			}
+			code, err := run(ctx, args, stdout, stderr, version, commitHash, buildDate, openFile)
+			if code != 0 {
+				if err == nil {
+					err = errors.New("invalid recorded command")
+				}
+				return code, fmt.Errorf("regen %s: %v", f.path, err)
+			}
+		}
 	case subCmd == "version":
 		if err := versionCmd.Parse(args[1:]); err != nil {
 			return 2, nil
 		}
+		if *versionJSON {
+			info := struct {
+				Version    string `json:"version"`
+				CommitHash string `json:"commitHash"`
+				BuildDate  string `json:"buildDate"`
+			}{version, commitHash, buildDate}
+			if err := json.NewEncoder(stdout).Encode(info); err != nil {
+				return 1, err
+			}
+			return 0, nil
+		}
 		if _, err := fmt.Fprintf(stdout, `Valctx is a tool to generate convenient setters and getters for context values.
 Version:     %s
 Build Date:  %s
@@ -146,3 +369,210 @@ Commit Hash: %s
 	}
 	return 0, nil
 }
+
+// printDiagnostics prints the diagnostics in human-readable format, one per line,
+// with the -field flag number or the position of invalid fields.
+func printDiagnostics(w io.Writer, diags []valctxgen.Diagnostic) {
+	for _, d := range diags {
+		what, where := "flags", ""
+		if d.Index >= 0 {
+			what, where = "fields", fmt.Sprintf(" (-field #%d)", d.Index+1)
+		}
+		if d.Pos != "" {
+			where = " (" + d.Pos + ")"
+		}
+		_, _ = fmt.Fprintf(w, "invalid %s: %s%s\n", what, d.Message, where)
+	}
+}
+
+// checkOutputVersion reports an error if the output file was generated by a valctx version
+// newer than the given one. Versions not following semantic versioning are not compared.
+func checkOutputVersion(output, version string) error {
+	src, err := ioutil.ReadFile(output)
+	if err != nil {
+		return nil
+	}
+	outputVersion, err := valctxgen.ReadVersion(src)
+	if err != nil {
+		return nil
+	}
+	if cmp, ok := compareVersions(outputVersion, version); ok && cmp > 0 {
+		return fmt.Errorf("%s was generated by valctx %s, newer than %s", output, outputVersion, version)
+	}
+	return nil
+}
+
+// compareVersions compares semantic versions in vMAJOR.MINOR.PATCH[-PRERELEASE][+BUILD] format,
+// it returns -1, 0 or +1 like strings.Compare. ok is false if any of the versions is invalid.
+func compareVersions(a, b string) (cmp int, ok bool) {
+	va, okA := parseVersion(a)
+	vb, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	for i := 0; i < 3; i++ {
+		if va.numbers[i] != vb.numbers[i] {
+			return compareInts(va.numbers[i], vb.numbers[i]), true
+		}
+	}
+	// A pre-release version has lower precedence than the release.
+	switch {
+	case va.prerelease == nil && vb.prerelease == nil:
+		return 0, true
+	case va.prerelease == nil:
+		return 1, true
+	case vb.prerelease == nil:
+		return -1, true
+	}
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		x, y := va.prerelease[i], vb.prerelease[i]
+		nx, errX := strconv.Atoi(x)
+		ny, errY := strconv.Atoi(y)
+		switch {
+		case errX == nil && errY == nil:
+			if nx != ny {
+				return compareInts(nx, ny), true
+			}
+		case errX == nil: // numeric identifiers are lower than alphanumeric ones
+			return -1, true
+		case errY == nil:
+			return 1, true
+		case x != y:
+			if x < y {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return compareInts(len(va.prerelease), len(vb.prerelease)), true
+}
+
+type semver struct {
+	numbers    [3]int
+	prerelease []string
+}
+
+func parseVersion(v string) (semver, bool) {
+	var sv semver
+	if !strings.HasPrefix(v, "v") {
+		return sv, false
+	}
+	v = v[1:]
+	if i := strings.Index(v, "+"); i >= 0 {
+		v = v[:i]
+	}
+	if i := strings.Index(v, "-"); i >= 0 {
+		sv.prerelease = strings.Split(v[i+1:], ".")
+		v = v[:i]
+	}
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return sv, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return sv, false
+		}
+		sv.numbers[i] = n
+	}
+	return sv, true
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// generatedFile is a file generated by valctx with the recorded command flags.
+type generatedFile struct {
+	path string
+	args []string
+}
+
+// findGeneratedFiles returns the files generated by valctx matching the patterns,
+// see walkGoFiles. Files given explicitly must be generated by valctx.
+func findGeneratedFiles(patterns []string) ([]generatedFile, error) {
+	var files []generatedFile
+	err := walkGoFiles(patterns, func(path string, found bool) error {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		args, err := valctxgen.ReadArgs(src)
+		if err == valctxgen.ErrNotGenerated && found {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		files = append(files, generatedFile{path: path, args: args})
+		return nil
+	})
+	return files, err
+}
+
+// walkGoFiles calls fn for the Go files matching the patterns: files, directories or directory
+// trees in dir/... format. found is false for the files given explicitly. Like the go command,
+// the search skips test files, testdata and vendor directories, and directories starting with . or _.
+func walkGoFiles(patterns []string, fn func(path string, found bool) error) error {
+	for _, pattern := range patterns {
+		recursive := pattern == "..." || strings.HasSuffix(pattern, "/...")
+		root := strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/")
+		if root == "" {
+			root = "."
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			if err = fn(root, false); err != nil {
+				return err
+			}
+			continue
+		}
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				name := info.Name()
+				if path != root && (!recursive || name == "testdata" || name == "vendor" ||
+					strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, ".go") || strings.HasSuffix(path, "_test.go") {
+				return nil
+			}
+			return fn(path, true)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldFlags is the value of the repeated -field flag. The fields are parsed with the spec,
+// so that invalid fields are reported with the other problems.
+type fieldFlags []string
+
+func (a *fieldFlags) String() string {
+	if a == nil {
+		return ""
+	}
+	return strings.Join(*a, ",")
+}
+
+func (a *fieldFlags) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
@@ -4,11 +4,18 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"go/build"
 	"io"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
+
+	"github.com/hightech-ninja/valctx/internal/app"
+	"github.com/hightech-ninja/valctx/internal/gen"
 )
 
 var (
@@ -24,6 +31,7 @@ func TestRun(t *testing.T) {
 		// params
 		name           string
 		skip           bool
+		ctx            context.Context
 		args           []string
 		stdout, stderr io.Writer
 		buildInfo      buildInfo
@@ -41,7 +49,10 @@ func TestRun(t *testing.T) {
 		if tt.skip {
 			t.Skip()
 		}
-		ctx := context.Background()
+		ctx := tt.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
 
 		var file io.WriteCloser
 		if tt.checkFile != nil {
@@ -129,12 +140,12 @@ func TestRun(t *testing.T) {
 	t.Run("invalid usage", func(t *testing.T) {
 		for _, tt := range []basetest{
 			{
-				name:        "unknown command",
-				args:        []string{"cmd"},
-				stdout:      &recordFile{},
-				stderr:      &recordFile{},
-				checkStderr: requireContent("regexp", "^invalid flags: output file is required"),
-				wantCode:    2,
+				name:     "unknown command",
+				args:     []string{"cmd"},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 1,
+				wantErr:  errors.New("stat cmd: no such file or directory"),
 			},
 			{
 				name:   "unknown flag & version cmd",
@@ -151,7 +162,7 @@ func TestRun(t *testing.T) {
 			},
 			{
 				name:        "unknown flag & root cmd",
-				args:        []string{"-output", "output.go", "-package", "gen", "-field", "UserID", "--undefined-flag", "value"},
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID", "--undefined-flag", "value"},
 				stdout:      &recordFile{},
 				stderr:      &recordFile{},
 				wantCode:    2,
@@ -166,16 +177,24 @@ func TestRun(t *testing.T) {
 				checkStderr: requireContent("regexp", "^invalid flags: output file is required"),
 			},
 			{
-				name:        "root cmd & missed package",
-				args:        []string{"-output", "output.go", "-field", "UserID"},
+				name:        "root cmd & package not inferred",
+				args:        []string{"-output", "1.0/output.go", "-field", "UserID"},
 				stdout:      &recordFile{},
 				stderr:      &recordFile{},
 				wantCode:    2,
-				checkStderr: requireContent("regexp", "^invalid flags: package name is required"),
+				checkStderr: requireContent("regexp", "^invalid flags: can't infer package name from directory 1.0"),
+			},
+			{
+				name:        "root cmd & package conflicts with output directory",
+				args:        []string{"-output", "testdata/regen/gen/other.go", "-package", "other", "-field", "TraceIDs"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", "^invalid flags: package other conflicts with package gen declared in testdata.regen.gen"),
 			},
 			{
 				name:        "root cmd & missed field",
-				args:        []string{"-output", "output.go", "-package", "gen"},
+				args:        []string{"-output", "gen/output.go", "-package", "gen"},
 				stdout:      &recordFile{},
 				stderr:      &recordFile{},
 				wantCode:    2,
@@ -183,17 +202,325 @@ func TestRun(t *testing.T) {
 			},
 			{
 				name:        "root cmd & field full duplicate",
-				args:        []string{"-output", "output.go", "-package", "gen", "-field", "UserID", "-field", "UserID"},
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID", "-field", "UserID"},
 				stdout:      &recordFile{},
 				stderr:      &recordFile{},
 				wantCode:    2,
 				checkStderr: requireContent("regexp", "^invalid fields: field .* is duplicated"),
 			}, {
 				name:     "root cmd & field partial duplicate",
-				args:     []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string", "-field", "UserID:int"},
+				args:     []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string", "-field", "UserID:int"},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 2,
+			},
+			{
+				name:        "root cmd & unknown field option",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string,undefined"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "UserID": unknown option "undefined" \(-field #1\)\n`),
+			},
+			{
+				name: "root cmd & json diagnostics of unparsable fields",
+				args: []string{
+					"-output", "gen/output.go", "-package", "gen", "-diagnostics", "json",
+					"-field", "A:string,bogus", "-field", "B:int,copy", "-field", "A:string",
+				},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 2,
+				checkStdout: requireContent("eq", `[{"index":0,"field":"A","message":"invalid field \"A\": unknown option \"bogus\""},`+
+					`{"index":1,"field":"B","message":"invalid field \"B\": copy requires a slice, map or pointer type"},`+
+					`{"index":2,"field":"A","message":"field \"A\" is duplicated"}]`+"\n"),
+				checkStderr: requireContent("eq", ""),
+			},
+			{
+				name: "root cmd & merge unparsable fields",
+				args: []string{
+					"-output", "testdata/regen/gen/ctx.go", "-merge",
+					"-field", "A:string,bogus", "-field", "B:string", "-field", "C:",
+				},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "A": unknown option "bogus" \(-field #1\)\n`+
+					`invalid fields: invalid field "C": type is required \(-field #3\)\n\nUsage:`),
+			},
+			{
+				name:        "root cmd & field option without value",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string,renamed-from"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `option "renamed-from" requires a value`),
+			},
+			{
+				name:        "root cmd & unsupported field option value",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string,set-once=ignore"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `option "set-once": unsupported value "ignore"`),
+			},
+			{
+				name:        "root cmd & copy of not copyable type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:[2]string,copy"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "UserID": copy requires a slice, map or pointer type`),
+			},
+			{
+				name:        "root cmd & kind option combined with other options",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "User:string,lazy,set-once"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `option "lazy" can't be combined with other options`),
+			},
+			{
+				name:        "root cmd & closer of built-in type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Resource:[]byte,closer"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Resource": closer requires a type implementing io.Closer`),
+			},
+			{
+				name:        "root cmd & validator named like template variable",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "U:string,validate=v"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "U": validator v is shadowed by a variable of the generated code`),
+			},
+			{
+				name:        "root cmd & header of not string type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Count:int,header=X-Count"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Count": header requires the string type or a type of the generated package`),
+			},
+			{
+				name:        "root cmd & header of imported type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Timeout:time.Duration,header=X-Timeout"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Timeout": header requires the string type or a type of the generated package`),
+			},
+			{
+				name:        "root cmd & required without header",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "TenantID:string,required"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "TenantID": required requires a header`),
+			},
+			{
+				name:        "root cmd & invalid go version",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-go", "1.6", "-field", "UserID"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid flags: go version must be 1.7 or later`),
+			},
+			{
+				name:        "root cmd & runtime keys before go 1.18",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-runtime-keys", "-field", "UserID"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "UserID": runtime keys require go 1.18 or later`),
+			},
+			{
+				name:        "root cmd & runtime key with options",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-go", "1.18", "-runtime-keys", "-field", "UserID:string,set-once"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "UserID": runtime key field doesn't support options`),
+			},
+			{
+				name: "root cmd & several invalid fields",
+				args: []string{
+					"-output", "gen/output.go", "-package", "gen",
+					"-field", "Count:int,copy", "-field", "UserID", "-field", "UserID:string",
+				},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Count": copy requires a slice, map or pointer type \(-field #1\)\n`+
+					`invalid fields: field "UserID" is duplicated \(-field #3\)\n\nUsage:`),
+			},
+			{
+				name: "root cmd & json diagnostics",
+				args: []string{
+					"-output", "gen/output.go", "-package", "gen", "-go", "1.6", "-diagnostics", "json",
+					"-field", "Count:int,copy", "-field", "UserID", "-field", "UserID:string",
+				},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				wantCode: 2,
+				checkStdout: requireContent("eq", `[{"setting":"GoVersion","index":-1,"message":"go version must be 1.7 or later"},`+
+					`{"index":0,"field":"Count","message":"invalid field \"Count\": copy requires a slice, map or pointer type"},`+
+					`{"index":2,"field":"UserID","message":"field \"UserID\" is duplicated"}]`+"\n"),
+				checkStderr: requireContent("eq", ""),
+			},
+			{
+				name:        "root cmd & unsupported diagnostics format",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-diagnostics", "xml", "-field", "UserID"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid flags: unsupported diagnostics format "xml"`),
+			},
+			{
+				name:        "root cmd & output generated by newer version",
+				args:        []string{"-output", "testdata/regen/gen/ctx.go", "-package", "gen", "-field", "UserID"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				buildInfo:   buildInfo{version: "v0.0.0"},
+				openFile:    record,
+				wantCode:    0,
+				checkStderr: requireContent("eq", "warning: testdata/regen/gen/ctx.go was generated by valctx v0.0.1, newer than v0.0.0\n"),
+			},
+			{
+				name:      "root cmd & output generated by newer version & strict version",
+				args:      []string{"-output", "testdata/regen/gen/ctx.go", "-package", "gen", "-strict-version", "-field", "UserID"},
+				stdout:    &recordFile{},
+				stderr:    &recordFile{},
+				buildInfo: buildInfo{version: "v0.0.0"},
+				openFile:  record,
+				wantCode:  1,
+				wantErr:   errors.New("testdata/regen/gen/ctx.go was generated by valctx v0.0.1, newer than v0.0.0"),
+			},
+			{
+				name:        "root cmd & merge conflicting type",
+				args:        []string{"-output", "testdata/regen/gen/ctx.go", "-merge", "-field", "TraceIDs:[]string", "-field", "UserID:int"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				openFile:    record,
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "UserID": type int conflicts with type string of the existing field \(-field #2\)\n`),
+			},
+			{
+				name:     "root cmd & merge into file not generated by valctx",
+				args:     []string{"-output", "testdata/regen/gen/session.go", "-merge", "-field", "UserID"},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				openFile: record,
+				wantCode: 1,
+				wantErr:  errors.New("merge: testdata/regen/gen/session.go: file is not generated by valctx"),
+			},
+			{
+				name:        "root cmd & collision with another file of the package",
+				args:        []string{"-output", "testdata/regen/gen/other.go", "-package", "gen", "-field", "UserID:int"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				openFile:    record,
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: userIDKey of field "UserID" is already declared at testdata.regen.gen.ctx.go:\d+:\d+ \(-field #1\)\n`),
+			},
+			{
+				name:        "root cmd & keyword package name",
+				args:        []string{"-output", "gen/output.go", "-package", "type", "-field", "UserID"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid flags: invalid package name`),
+			},
+			{
+				name:        "root cmd & nil-is-absent for not nilable type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Count:int,nil-is-absent"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Count": nil-is-absent requires a pointer`),
+			},
+			{
+				name:        "root cmd & unsupported global nil-is-absent",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-nil-is-absent", "yes", "-field", "Count:int"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid flags: unsupported nil-is-absent value "yes"`),
+			},
+			{
+				name:        "root cmd & invalid validator",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "TenantID:string,validate:github.com/user/pkg.validate"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "TenantID": invalid validator`),
+			},
+			{
+				name:        "root cmd & any before go 1.18",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Data:[]any"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Data": any requires go 1.18 or later`),
+			},
+			{
+				name:        "root cmd & generic type before go 1.18",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Value:example.com/opt.Option[string]"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Value": generic types require -go 1.18 or later`),
+			},
+			{
+				name:        "root cmd & several type arguments before go 1.18",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Cache:*example.com/cache.Map[string, []int]"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Cache": generic types require -go 1.18 or later \(-field #1\)\n`),
+			},
+			{
+				name:        "root cmd & generic type argument not a type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-go", "1.18", "-field", "Value:example.com/opt.Option[1]"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: invalid field "Value": invalid type`),
+			},
+			{
+				name:        "root cmd & undeclared local type",
+				args:        []string{"-output", "gen/output.go", "-package", "gen", "-verify-local-types", "-field", "Session:*.Session"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: type Session of field "Session" is not declared in gen`),
+			},
+			{
+				name: "root cmd & former field name duplicate",
+				args: []string{
+					"-output", "gen/output.go", "-package", "gen",
+					"-field", "UserID:string",
+					"-field", "AccountID:string,renamed-from=UserID",
+				},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", `^invalid fields: field "UserID" is duplicated`),
+			},
+			{
+				name: "root cmd & clashing accessors",
+				args: []string{
+					"-output", "gen/output.go", "-package", "gen",
+					"-field", "User:string,lazy",
+					"-field", "UserLoader:string",
+				},
 				stdout:   &recordFile{},
 				stderr:   &recordFile{},
 				wantCode: 2,
+				checkStderr: requireContent("regexp",
+					`^invalid fields: SetUserLoader of field "UserLoader" is also generated for field "User" \(-field #2\)\n`),
 			},
 		} {
 			t.Run(tt.name, func(t *testing.T) {
@@ -221,6 +548,125 @@ Commit Hash: main
 $`),
 				wantCode: 0,
 			},
+			{
+				name:   "version json",
+				args:   []string{"version", "-json"},
+				stdout: &recordFile{},
+				stderr: &recordFile{},
+				buildInfo: buildInfo{
+					version:    "v1.2.3",
+					commitHash: "main",
+					buildDate:  "2025-01-01",
+				},
+				checkStdout: requireContent("eq", `{"version":"v1.2.3","commitHash":"main","buildDate":"2025-01-01"}`+"\n"),
+				wantCode:    0,
+			},
+			{
+				name:      "regen by older version with strict version",
+				args:      []string{"regen", "-strict-version", "testdata/regen/..."},
+				stdout:    &recordFile{},
+				stderr:    &recordFile{},
+				buildInfo: buildInfo{version: "v0.0.1-rc.1"},
+				openFile:  record,
+				wantCode:  1,
+				wantErr:   errors.New("testdata/regen/gen/ctx.go was generated by valctx v0.0.1, newer than v0.0.1-rc.1"),
+			},
+			{
+				name:      "regen",
+				args:      []string{"regen", "testdata/regen/..."},
+				stdout:    &recordFile{},
+				stderr:    &recordFile{},
+				buildInfo: buildInfo{version: "v1.2.3"},
+				openFile:  record,
+				checkFile: requireContent("regexp", "^// Code generated by valctx v1.2.3. DO NOT EDIT.\n"+
+					"// valctx -package gen \\\\\n//   -field UserID:string \\\\\n//   -field 'Session:\\*.Session'\n\npackage gen\n"),
+				wantCode: 0,
+			},
+			{
+				name:     "regen file not generated by valctx",
+				args:     []string{"regen", "testdata/regen/gen/session.go"},
+				stdout:   &recordFile{},
+				stderr:   &recordFile{},
+				openFile: record,
+				wantCode: 1,
+				wantErr:  errors.New("testdata/regen/gen/session.go: file is not generated by valctx"),
+			},
+			{
+				name:      "batch",
+				args:      []string{"-jobs", "2", "testdata/batch/..."},
+				stdout:    &recordFile{},
+				stderr:    &recordFile{},
+				buildInfo: buildInfo{version: "v1.2.3"},
+				openFile:  record,
+				checkStdout: requireContent("eq", "unchanged testdata/batch/a/ctx.go\n"+
+					"changed   testdata/batch/b/gen/ctx.go\n"+
+					"failed    testdata/batch/c/ctx.go\n"+
+					"1 changed, 1 unchanged, 1 failed\n"),
+				checkStderr: requireContent("eq", `testdata/batch/c/c.go:3:1: invalid fields: invalid field "Bad name": invalid name (-field #1)`+"\n"),
+				checkFile: requireContent("regexp", "^// Code generated by valctx v1.2.3. DO NOT EDIT.\n"+
+					"// valctx -package gen \\\\\n//   -field 'TraceIDs:\\[\\]string' \\\\\n//   -field Tags:string,append\n\npackage gen\n"),
+				wantCode: 1,
+				wantErr:  errors.New("1 of 3 outputs failed"),
+			},
+			{
+				name:        "batch canceled",
+				ctx:         canceledContext(),
+				args:        []string{"testdata/batch/a", "testdata/batch/a/a.go"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				openFile:    record,
+				checkStdout: requireContent("eq", "skipped   testdata/batch/a/ctx.go\n0 changed, 0 unchanged, 0 failed, 1 skipped\n"),
+				checkStderr: requireContent("eq", ""),
+				wantCode:    1,
+				wantErr:     errors.New("1 of 1 outputs skipped: context canceled"),
+			},
+			{
+				name:        "batch without directives",
+				args:        []string{"testdata/regen/..."},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				checkStdout: requireContent("eq", ""),
+				checkStderr: requireContent("eq", "warning: no //valctx:generate directives found\n"),
+				wantCode:    0,
+			},
+			{
+				name:        "batch with spec flags",
+				args:        []string{"-package", "gen", "testdata/batch/..."},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				checkStderr: requireContent("regexp", "^invalid flags: flag -package can't be used with files or directories"),
+				wantCode:    2,
+			},
+			{
+				name:      "scan fields",
+				args:      []string{"-output", "testdata/fields/ctx.go", "-scan-fields"},
+				stdout:    &recordFile{},
+				stderr:    &recordFile{},
+				buildInfo: buildInfo{version: "v1.2.3"},
+				openFile:  record,
+				checkFile: requireContent("regexp", "^// Code generated by valctx v1.2.3. DO NOT EDIT.\n"+
+					"// valctx -package fields -scan-fields\n\npackage fields\n(.|\n)*"+
+					"func SetTenantID\\(ctx context.Context, v TenantID\\) context.Context {\n(.|\n)*"+
+					"\tif v := h.Get\\(\"X-Tenant\"\\); v != \"\" {\n\t\tnext = SetTenantID\\(next, TenantID\\(v\\)\\)\n"+
+					"\t} else {\n\t\treturn ctx, ErrTenantIDHeaderMissing\n\t}\n"),
+				wantCode: 0,
+			},
+			{
+				name:        "scan fields without directives",
+				args:        []string{"-output", "testdata/regen/gen/other.go", "-scan-fields"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				checkStderr: requireContent("regexp", "^invalid flags: at least one field is required, no //valctx:field directives found in testdata.regen.gen\n"),
+				wantCode:    2,
+			},
+			{
+				name:        "regen without files",
+				args:        []string{"regen"},
+				stdout:      &recordFile{},
+				stderr:      &recordFile{},
+				wantCode:    2,
+				checkStderr: requireContent("regexp", "^Usage: valctx regen"),
+			},
 		} {
 			t.Run(tt.name, func(t *testing.T) {
 				runTest(t, tt)
@@ -233,7 +679,7 @@ $`),
 			for _, tt := range []basetest{
 				{
 					name:   "file open error",
-					args:   []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string"},
+					args:   []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string"},
 					stdout: ioutil.Discard,
 					stderr: ioutil.Discard,
 					openFile: func(name string) (io.WriteCloser, error) {
@@ -244,7 +690,7 @@ $`),
 				},
 				{
 					name:   "file close error",
-					args:   []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string"},
+					args:   []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string"},
 					stdout: &recordFile{},
 					stderr: &recordFile{},
 					openFile: mockfile(nil, func() error {
@@ -255,7 +701,7 @@ $`),
 				},
 				{
 					name:   "file write error",
-					args:   []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string"},
+					args:   []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string"},
 					stdout: &recordFile{},
 					stderr: &recordFile{},
 					openFile: mockfile(func(p []byte) (n int, err error) {
@@ -264,9 +710,19 @@ $`),
 					wantCode: 1,
 					wantErr:  ErrTest,
 				},
+				{
+					name:        "generated code doesn't compile",
+					args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "Tx:*database/sql.Tx,closer"},
+					stdout:      ioutil.Discard,
+					stderr:      ioutil.Discard,
+					openFile:    mockfile(nil, nil, nil),
+					checkRename: withoutRename,
+					wantCode:    1,
+					wantErr:     errors.New("generate: generated code is invalid: output.go:"),
+				},
 				{
 					name:        "file must be renamed on gen success",
-					args:        []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string"},
+					args:        []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string"},
 					stdout:      ioutil.Discard,
 					stderr:      ioutil.Discard,
 					openFile:    mockfile(nil, nil, nil),
@@ -275,7 +731,7 @@ $`),
 				},
 				{
 					name:   "file must not be renamed on gen error",
-					args:   []string{"-output", "output.go", "-package", "gen", "-field", "UserID:string"},
+					args:   []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID:string"},
 					stdout: ioutil.Discard,
 					stderr: ioutil.Discard,
 					openFile: mockfile(func(p []byte) (n int, err error) {
@@ -297,7 +753,7 @@ $`),
 				{
 					name: "not built-in types #1",
 					args: []string{
-						"-output", "output.go",
+						"-output", "gen/output.go",
 						"-package", "gen",
 						"-field", "Field1:invalid",
 						"-field", "Field2:strings",
@@ -313,7 +769,7 @@ $`),
 				{
 					name: "not built-in types #2",
 					args: []string{
-						"-output", "output.go",
+						"-output", "gen/output.go",
 						"-package", "gen",
 						"-field", "Field2:strings",
 					},
@@ -325,7 +781,7 @@ $`),
 				{
 					name: "not built-in types #3",
 					args: []string{
-						"-output", "output.go",
+						"-output", "gen/output.go",
 						"-package", "gen",
 						"-field", "Field3:int[]",
 					},
@@ -337,7 +793,7 @@ $`),
 				{
 					name: "not built-in types #4",
 					args: []string{
-						"-output", "output.go",
+						"-output", "gen/output.go",
 						"-package", "gen",
 						"-field", "Field4:[]int[]",
 					},
@@ -349,7 +805,7 @@ $`),
 				{
 					name: "not built-in types #5",
 					args: []string{
-						"-output", "output.go",
+						"-output", "gen/output.go",
 						"-package", "gen",
 						"-field", "Field5:3+3*3",
 					},
@@ -369,29 +825,31 @@ $`),
 			for _, tt := range []basetest{
 				{
 					name:     "default field type must be interface{}",
-					args:     []string{"-output", "output.go", "-package", "gen", "-field", "UserID"},
+					args:     []string{"-output", "gen/output.go", "-package", "gen", "-field", "UserID"},
 					stdout:   ioutil.Discard,
 					stderr:   ioutil.Discard,
 					openFile: record,
 					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field UserID
 
 package gen
 
 import (
-    "context"
+	"context"
 )
 
 type userIDKey struct{}
 
 // Get UserID retrieves the UserID from the context.
 func GetUserID(ctx context.Context) interface{} {
-    v := ctx.Value(userIDKey{})
-    return v
+	v := ctx.Value(userIDKey{})
+	return v
 }
 
 // SetUserID sets the UserID in the context.
 func SetUserID(ctx context.Context, v interface{}) context.Context {
-    return context.WithValue(ctx, userIDKey{}, v)
+	return context.WithValue(ctx, userIDKey{}, v)
 }
 `),
 					wantCode: 0,
@@ -399,7 +857,7 @@ func SetUserID(ctx context.Context, v interface{}) context.Context {
 				{
 					name: "fields with built-in types",
 					args: []string{
-						"-output", "output.go", "-package", "gen",
+						"-output", "gen/output.go", "-package", "gen",
 						"-field", "Field1:int8",
 						"-field", "Field2:[]string",
 						"-field", "Field3:map[string]rune",
@@ -411,11 +869,12 @@ func SetUserID(ctx context.Context, v interface{}) context.Context {
 					wantCode: 0,
 				},
 				{
-					name: "fields with exported types",
+					name: "fields with predeclared interface types",
 					args: []string{
-						"-output", "output.go", "-package", "gen",
-						"-field", "Field1:github.com/user/pkg.User",
-						"-field", "Field2:context.Context",
+						"-output", "gen/output.go", "-package", "gen", "-go", "1.18",
+						"-field", "Field1:error",
+						"-field", "Field2:any",
+						"-field", "Field3:map[string]any",
 					},
 					stdout:   ioutil.Discard,
 					stderr:   ioutil.Discard,
@@ -423,44 +882,1907 @@ func SetUserID(ctx context.Context, v interface{}) context.Context {
 					wantCode: 0,
 				},
 				{
-					name: "field name capitalized (unexported to exported)",
+					name: "fields with local types",
 					args: []string{
-						"-output", "output.go", "-package", "gen",
-						"-field", "field1:int",
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Session:.Session",
+						"-field", "User:*.user",
 					},
 					stdout:   ioutil.Discard,
 					stderr:   ioutil.Discard,
 					openFile: record,
 					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field Session:.Session \
+//   -field 'User:*.user'
 
 package gen
 
 import (
-    "context"
+	"context"
 )
 
-type field1Key struct{}
+type sessionKey struct{}
 
-// Get Field1 retrieves the Field1 from the context.
-func GetField1(ctx context.Context) (int, bool) {
-    v, ok := ctx.Value(field1Key{}).(int)
-    return v, ok
+// Get Session retrieves the Session from the context.
+func GetSession(ctx context.Context) (Session, bool) {
+	v, ok := ctx.Value(sessionKey{}).(Session)
+	return v, ok
 }
 
-// SetField1 sets the Field1 in the context.
-func SetField1(ctx context.Context, v int) context.Context {
-    return context.WithValue(ctx, field1Key{}, v)
+// SetSession sets the Session in the context.
+func SetSession(ctx context.Context, v Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, v)
+}
+
+type userKey struct{}
+
+// Get User retrieves the User from the context.
+func GetUser(ctx context.Context) (*user, bool) {
+	v, ok := ctx.Value(userKey{}).(*user)
+	return v, ok
+}
+
+// SetUser sets the User in the context.
+func SetUser(ctx context.Context, v *user) context.Context {
+	return context.WithValue(ctx, userKey{}, v)
 }
 `),
 					wantCode: 0,
 				},
-			} {
-				t.Run(tt.name, func(t *testing.T) {
+				{
+					name: "runtime keys",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen", "-go", "1.18", "-runtime-keys",
+						"-field", "UserID:string",
+						"-field", "Data",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen -go 1.18 -runtime-keys \
+//   -field UserID:string \
+//   -field Data
+
+package gen
+
+import (
+	"context"
+
+	"github.com/hightech-ninja/valctx"
+)
+
+// UserIDKey is the key of the UserID, use it to access the UserID with the valctx package.
+var UserIDKey = valctx.NewKey[string]("UserID")
+
+// Get UserID retrieves the UserID from the context.
+func GetUserID(ctx context.Context) (string, bool) {
+	return UserIDKey.Get(ctx)
+}
+
+// SetUserID sets the UserID in the context.
+func SetUserID(ctx context.Context, v string) context.Context {
+	return UserIDKey.Set(ctx, v)
+}
+
+// DataKey is the key of the Data, use it to access the Data with the valctx package.
+var DataKey = valctx.NewKey[any]("Data")
+
+// Get Data retrieves the Data from the context.
+func GetData(ctx context.Context) any {
+	v, _ := DataKey.Get(ctx)
+	return v
+}
+
+// SetData sets the Data in the context.
+func SetData(ctx context.Context, v any) context.Context {
+	return DataKey.Set(ctx, v)
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "go 1.22 target",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen", "-go", "1.22",
+						"-field", "UserID",
+						"-field", "TraceIDs:[]string,copy=set",
+						"-field", "Tags:string,append",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen -go 1.22 \
+//   -field UserID \
+//   -field 'TraceIDs:[]string,copy=set' \
+//   -field Tags:string,append
+
+package gen
+
+import (
+	"context"
+	"slices"
+)
+
+type userIDKey struct{}
+
+// Get UserID retrieves the UserID from the context.
+func GetUserID(ctx context.Context) any {
+	v := ctx.Value(userIDKey{})
+	return v
+}
+
+// SetUserID sets the UserID in the context.
+func SetUserID(ctx context.Context, v any) context.Context {
+	return context.WithValue(ctx, userIDKey{}, v)
+}
+
+type traceIDsKey struct{}
+
+// Get TraceIDs retrieves the TraceIDs from the context.
+func GetTraceIDs(ctx context.Context) ([]string, bool) {
+	v, ok := ctx.Value(traceIDsKey{}).([]string)
+	return v, ok
+}
+
+// SetTraceIDs sets the TraceIDs in the context.
+// The context keeps a copy of v.
+func SetTraceIDs(ctx context.Context, v []string) context.Context {
+	v = cloneTraceIDs(v)
+	return context.WithValue(ctx, traceIDsKey{}, v)
+}
+
+// cloneTraceIDs returns a shallow copy of v.
+func cloneTraceIDs(v []string) []string {
+	return slices.Clone(v)
+}
+
+type tagsKey struct{}
+
+// Get Tags retrieves all the Tags appended to the context.
+// The returned slice must not be modified.
+func GetTags(ctx context.Context) []string {
+	v, _ := ctx.Value(tagsKey{}).([]string)
+	return v
+}
+
+// AppendTags appends v to the Tags in the context.
+// The Tags of the parent context are not modified.
+func AppendTags(ctx context.Context, v ...string) context.Context {
+	return context.WithValue(ctx, tagsKey{}, slices.Concat(GetTags(ctx), v))
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "merge fields",
+					args: []string{
+						"-output", "testdata/regen/gen/ctx.go", "-merge", "-go", "1.18",
+						"-field", "TraceIDs:[]string", "-field", "UserID:string,set-once",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("regexp", "^// Code generated by valctx . DO NOT EDIT.\n"+
+						"// valctx -package gen -go 1.18 \\\\\n"+
+						"//   -field 'Session:\\*.Session' \\\\\n"+
+						"//   -field 'TraceIDs:\\[\\]string' \\\\\n"+
+						"//   -field UserID:string,set-once\n\npackage gen\n"),
+					wantCode: 0,
+				},
+				{
+					name:     "merge fields into missing file",
+					args:     []string{"-output", "testdata/missing/ctx.go", "-merge", "-package", "gen", "-field", "UserID"},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("regexp", "^// Code generated by valctx . DO NOT EDIT.\n"+
+						"// valctx -package gen \\\\\n//   -field UserID\n"),
+					wantCode: 0,
+				},
+				{
+					name:      "package of output directory",
+					args:      []string{"-output", "testdata/regen/gen/other.go", "-field", "TraceIDs"},
+					stdout:    ioutil.Discard,
+					stderr:    ioutil.Discard,
+					openFile:  record,
+					checkFile: requireContent("regexp", "\n\npackage gen\n"),
+					wantCode:  0,
+				},
+				{
+					name:      "package of output directory name",
+					args:      []string{"-output", "my-pkg/output.go", "-field", "TraceIDs"},
+					stdout:    ioutil.Discard,
+					stderr:    ioutil.Discard,
+					openFile:  record,
+					checkFile: requireContent("regexp", "\n\npackage mypkg\n"),
+					wantCode:  0,
+				},
+				{
+					name: "fields with generic types",
+					skip: !supportsGoVersion("1.18"),
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen", "-go", "1.18",
+						"-field", "Value:example.com/opt.Option[github.com/google/uuid.UUID]",
+						"-field", "Cache:*example.com/cache.Map[string, []example.com/opt.Option[.Session]]",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen -go 1.18 \
+//   -field 'Value:example.com/opt.Option[github.com/google/uuid.UUID]' \
+//   -field 'Cache:*example.com/cache.Map[string, []example.com/opt.Option[.Session]]'
+
+package gen
+
+import (
+	"context"
+
+	"example.com/cache"
+	"example.com/opt"
+	"github.com/google/uuid"
+)
+
+type valueKey struct{}
+
+// Get Value retrieves the Value from the context.
+func GetValue(ctx context.Context) (opt.Option[uuid.UUID], bool) {
+	v, ok := ctx.Value(valueKey{}).(opt.Option[uuid.UUID])
+	return v, ok
+}
+
+// SetValue sets the Value in the context.
+func SetValue(ctx context.Context, v opt.Option[uuid.UUID]) context.Context {
+	return context.WithValue(ctx, valueKey{}, v)
+}
+
+type cacheKey struct{}
+
+// Get Cache retrieves the Cache from the context.
+func GetCache(ctx context.Context) (*cache.Map[string, []opt.Option[Session]], bool) {
+	v, ok := ctx.Value(cacheKey{}).(*cache.Map[string, []opt.Option[Session]])
+	return v, ok
+}
+
+// SetCache sets the Cache in the context.
+func SetCache(ctx context.Context, v *cache.Map[string, []opt.Option[Session]]) context.Context {
+	return context.WithValue(ctx, cacheKey{}, v)
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "fields with exported types",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Field1:github.com/user/pkg.User",
+						"-field", "Field2:context.Context",
+						"-field", "Field3:*github.com/user/pkg.User",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: devnull,
+					wantCode: 0,
+				},
+				{
+					name: "field name capitalized (unexported to exported)",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "field1:int",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field Field1:int
+
+package gen
+
+import (
+	"context"
+)
+
+type field1Key struct{}
+
+// Get Field1 retrieves the Field1 from the context.
+func GetField1(ctx context.Context) (int, bool) {
+	v, ok := ctx.Value(field1Key{}).(int)
+	return v, ok
+}
+
+// SetField1 sets the Field1 in the context.
+func SetField1(ctx context.Context, v int) context.Context {
+	return context.WithValue(ctx, field1Key{}, v)
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "renamed field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "TenantID:string,renamed-from=orgID",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field TenantID:string,renamed-from=orgID
+
+package gen
+
+import (
+	"context"
+)
+
+type tenantIDKey struct{}
+
+type orgIDKey struct{}
+
+// Get TenantID retrieves the TenantID from the context.
+// It falls back to the value stored with the former OrgID key.
+func GetTenantID(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(tenantIDKey{}).(string)
+	if !ok {
+		v, ok = ctx.Value(orgIDKey{}).(string)
+	}
+	return v, ok
+}
+
+// SetTenantID sets the TenantID in the context.
+func SetTenantID(ctx context.Context, v string) context.Context {
+	return context.WithValue(ctx, tenantIDKey{}, v)
+}
+
+// GetOrgID retrieves the TenantID from the context.
+//
+// Deprecated: OrgID is renamed, use GetTenantID instead.
+func GetOrgID(ctx context.Context) (string, bool) {
+	return GetTenantID(ctx)
+}
+
+// SetOrgID sets the TenantID in the context.
+//
+// Deprecated: OrgID is renamed, use SetTenantID instead.
+func SetOrgID(ctx context.Context, v string) context.Context {
+	return SetTenantID(ctx, v)
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "set-once field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "TenantID:string,set-once",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field TenantID:string,set-once
+
+package gen
+
+import (
+	"context"
+	"errors"
+)
+
+type tenantIDKey struct{}
+
+// ErrTenantIDAlreadySet is reported by SetTenantID if the TenantID is already set in the context.
+var ErrTenantIDAlreadySet = errors.New("TenantID is already set in the context")
+
+// Get TenantID retrieves the TenantID from the context.
+func GetTenantID(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(tenantIDKey{}).(string)
+	return v, ok
+}
+
+// HasTenantID reports whether the TenantID is set in the context.
+func HasTenantID(ctx context.Context) bool {
+	_, ok := GetTenantID(ctx)
+	return ok
+}
+
+// SetTenantID sets the TenantID in the context.
+// It returns ErrTenantIDAlreadySet if the TenantID is already set.
+func SetTenantID(ctx context.Context, v string) (context.Context, error) {
+	if HasTenantID(ctx) {
+		return ctx, ErrTenantIDAlreadySet
+	}
+	return context.WithValue(ctx, tenantIDKey{}, v), nil
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "copy field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "TraceIDs:[]string,copy",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field 'TraceIDs:[]string,copy'
+
+package gen
+
+import (
+	"context"
+)
+
+type traceIDsKey struct{}
+
+// Get TraceIDs retrieves the TraceIDs from the context.
+// It returns a copy of the stored value.
+func GetTraceIDs(ctx context.Context) ([]string, bool) {
+	v, ok := ctx.Value(traceIDsKey{}).([]string)
+	return cloneTraceIDs(v), ok
+}
+
+// SetTraceIDs sets the TraceIDs in the context.
+// The context keeps a copy of v.
+func SetTraceIDs(ctx context.Context, v []string) context.Context {
+	v = cloneTraceIDs(v)
+	return context.WithValue(ctx, traceIDsKey{}, v)
+}
+
+// cloneTraceIDs returns a shallow copy of v.
+func cloneTraceIDs(v []string) []string {
+	if v == nil {
+		return nil
+	}
+	c := make([]string, len(v))
+	copy(c, v)
+	return c
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "versioned and colliding imports",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Node:*gopkg.in/yaml.v3.Node",
+						"-field", "Client:*example.com/api/v2.Client",
+						"-field", "Logger:*github.com/a/log.Logger",
+						"-field", "Sink:github.com/b/log.Sink,validate=github.com/b/log.CheckSink",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("regexp", `(?s)import \(
+	"context"
+
+	api "example.com/api/v2"
+	"github.com/a/log"
+	blog "github.com/b/log"
+	yaml "gopkg.in/yaml.v3"
+\)
+.*func GetNode\(ctx context.Context\) \(\*yaml.Node, bool\).*`+
+						`func GetClient\(ctx context.Context\) \(\*api.Client, bool\).*`+
+						`func GetLogger\(ctx context.Context\) \(\*log.Logger, bool\).*`+
+						`if err := blog.CheckSink\(v\); err != nil`),
+					wantCode: 0,
+				},
+				{
+					name: "validator package named like template variable",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "U:example.com/v.T,validate=example.com/v.Check",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("regexp", `(?s)examplecomv "example.com/v"
+.*func SetU\(ctx context.Context, v examplecomv.T\) \(context.Context, error\) \{
+	if err := examplecomv.Check\(v\); err != nil \{`),
+					wantCode: 0,
+				},
+				{
+					name: "imports named like template variables",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Request:example.com/ctx.Request",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("regexp", `(?s)import \(
+	"context"
+
+	examplecomctx "example.com/ctx"
+\)
+.*v, ok := ctx.Value\(requestKey\{\}\).\(examplecomctx.Request\)`),
+					wantCode: 0,
+				},
+				{
+					name: "lazy field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "User:github.com/user/pkg.User,lazy",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field User:github.com/user/pkg.User,lazy
+
+package gen
+
+import (
+	"context"
+	"sync"
+
+	"github.com/user/pkg"
+)
+
+type userKey struct{}
+
+// userLoader loads the User at most once.
+type userLoader struct {
+	once sync.Once
+	load func() (pkg.User, error)
+	v    pkg.User
+	err  error
+}
+
+// Get User retrieves the User from the context.
+// The loader is called on the first call only, its result and error are cached.
+// ok is false if the loader is not set.
+func GetUser(ctx context.Context) (v pkg.User, ok bool, err error) {
+	l, ok := ctx.Value(userKey{}).(*userLoader)
+	if !ok {
+		return v, false, nil
+	}
+	l.once.Do(func() {
+		l.v, l.err = l.load()
+	})
+	return l.v, true, l.err
+}
+
+// SetUserLoader sets the loader of the User in the context.
+// The loader is shared by all contexts derived from the returned one.
+// It panics if load is nil.
+func SetUserLoader(ctx context.Context, load func() (pkg.User, error)) context.Context {
+	if load == nil {
+		panic("SetUserLoader: nil loader")
+	}
+	return context.WithValue(ctx, userKey{}, &userLoader{load: load})
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "mutable field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Route:string,mutable",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field Route:string,mutable
+
+package gen
+
+import (
+	"context"
+	"sync"
+)
+
+type routeKey struct{}
+
+// routeHolder holds the Route shared by contexts derived from the one returned by InitRoute.
+type routeHolder struct {
+	mu sync.RWMutex
+	v  string
+	ok bool
+}
+
+// InitRoute installs the holder of the Route in the context.
+// If the holder is already installed, the context is returned as is.
+func InitRoute(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(routeKey{}).(*routeHolder); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, routeKey{}, &routeHolder{})
+}
+
+// StoreRoute stores the Route in the holder installed by InitRoute.
+// It reports false if the holder is not installed.
+func StoreRoute(ctx context.Context, v string) bool {
+	h, ok := ctx.Value(routeKey{}).(*routeHolder)
+	if !ok {
+		return false
+	}
+	h.mu.Lock()
+	h.v, h.ok = v, true
+	h.mu.Unlock()
+	return true
+}
+
+// LoadRoute retrieves the Route from the holder installed by InitRoute.
+// ok is false if the holder is not installed or the Route is not stored yet.
+func LoadRoute(ctx context.Context) (v string, ok bool) {
+	h, ok := ctx.Value(routeKey{}).(*routeHolder)
+	if !ok {
+		return v, false
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.v, h.ok
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "append field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Breadcrumbs:string,append",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field Breadcrumbs:string,append
+
+package gen
+
+import (
+	"context"
+)
+
+type breadcrumbsKey struct{}
+
+// Get Breadcrumbs retrieves all the Breadcrumbs appended to the context.
+// The returned slice must not be modified.
+func GetBreadcrumbs(ctx context.Context) []string {
+	v, _ := ctx.Value(breadcrumbsKey{}).([]string)
+	return v
+}
+
+// AppendBreadcrumbs appends v to the Breadcrumbs in the context.
+// The Breadcrumbs of the parent context are not modified.
+func AppendBreadcrumbs(ctx context.Context, v ...string) context.Context {
+	prev := GetBreadcrumbs(ctx)
+	next := make([]string, 0, len(prev)+len(v))
+	next = append(next, prev...)
+	next = append(next, v...)
+	return context.WithValue(ctx, breadcrumbsKey{}, next)
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "closer field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Rows:*database/sql.Rows,closer",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field 'Rows:*database/sql.Rows,closer'
+
+package gen
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+type rowsKey struct{}
+
+// Get Rows retrieves the Rows from the context.
+func GetRows(ctx context.Context) (*sql.Rows, bool) {
+	v, ok := ctx.Value(rowsKey{}).(*sql.Rows)
+	return v, ok
+}
+
+// SetRows sets the Rows in the context.
+// The Rows is closed when the context is done, unless the returned stop function is called before.
+// stop reports whether it prevented closing; call it if the context is never done to release resources.
+// The nil Rows is not closed.
+func SetRows(ctx context.Context, v *sql.Rows) (context.Context, func() bool) {
+	ctx = context.WithValue(ctx, rowsKey{}, v)
+	if v == nil {
+		return ctx, func() bool { return false }
+	}
+	var once sync.Once
+	stopped := make(chan struct{})
+	if done := ctx.Done(); done != nil {
+		go func() {
+			select {
+			case <-done:
+				once.Do(func() {
+					_ = v.Close()
+				})
+			case <-stopped:
+			}
+		}()
+	}
+	return ctx, func() bool {
+		ok := false
+		once.Do(func() {
+			ok = true
+			close(stopped)
+		})
+		return ok
+	}
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "ttl field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "Token:string,ttl",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field Token:string,ttl
+
+package gen
+
+import (
+	"context"
+	"time"
+)
+
+type tokenKey struct{}
+
+// tokenEntry is the Token stored with its expiry time.
+type tokenEntry struct {
+	v       string
+	expires time.Time
+}
+
+func (e tokenEntry) expired() bool {
+	return !e.expires.IsZero() && !nowToken().Before(e.expires)
+}
+
+// nowToken returns the current time to check the Token expiry.
+// Replace it in tests to control the time.
+var nowToken = time.Now
+
+// Get Token retrieves the Token from the context.
+// The expired Token is reported as absent.
+func GetToken(ctx context.Context) (string, bool) {
+	e, ok := ctx.Value(tokenKey{}).(tokenEntry)
+	if ok && e.expired() {
+		e, ok = tokenEntry{}, false
+	}
+	v := e.v
+	return v, ok
+}
+
+// SetToken sets the Token in the context.
+func SetToken(ctx context.Context, v string) context.Context {
+	return setToken(ctx, v, time.Time{})
+}
+
+// SetTokenWithTTL sets the Token in the context like SetToken,
+// but the Token expires after d.
+func SetTokenWithTTL(ctx context.Context, v string, d time.Duration) context.Context {
+	return setToken(ctx, v, nowToken().Add(d))
+}
+
+// setToken sets the Token expiring at the given time, zero time means no expiry.
+func setToken(ctx context.Context, v string, expires time.Time) context.Context {
+	return context.WithValue(ctx, tokenKey{}, tokenEntry{v: v, expires: expires})
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "nil-is-absent field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "User:*github.com/user/pkg.User,nil-is-absent=refuse",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field 'User:*github.com/user/pkg.User,nil-is-absent=refuse'
+
+package gen
+
+import (
+	"context"
+	"errors"
+
+	"github.com/user/pkg"
+)
+
+type userKey struct{}
+
+// ErrUserIsNil is returned by SetUser for nil values.
+var ErrUserIsNil = errors.New("User is nil")
+
+// Get User retrieves the User from the context.
+// The nil User is reported as absent.
+func GetUser(ctx context.Context) (*pkg.User, bool) {
+	v, ok := ctx.Value(userKey{}).(*pkg.User)
+	if ok && v == nil {
+		ok = false
+	}
+	return v, ok
+}
+
+// SetUser sets the User in the context.
+// It returns ErrUserIsNil for the nil User.
+func SetUser(ctx context.Context, v *pkg.User) (context.Context, error) {
+	if v == nil {
+		return ctx, ErrUserIsNil
+	}
+	return context.WithValue(ctx, userKey{}, v), nil
+}
+`),
+					wantCode: 0,
+				},
+				{
+					name: "validated field",
+					args: []string{
+						"-output", "gen/output.go", "-package", "gen",
+						"-field", "TenantID:string,validate:github.com/user/tenant.Validate",
+					},
+					stdout:   ioutil.Discard,
+					stderr:   ioutil.Discard,
+					openFile: record,
+					checkFile: requireContent("eq", `// Code generated by valctx . DO NOT EDIT.
+// valctx -package gen \
+//   -field TenantID:string,validate=github.com/user/tenant.Validate
+
+package gen
+
+import (
+	"context"
+
+	"github.com/user/tenant"
+)
+
+type tenantIDKey struct{}
+
+// Get TenantID retrieves the TenantID from the context.
+func GetTenantID(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(tenantIDKey{}).(string)
+	return v, ok
+}
+
+// SetTenantID sets the TenantID in the context.
+// It returns the error of tenant.Validate for invalid values.
+func SetTenantID(ctx context.Context, v string) (context.Context, error) {
+	if err := tenant.Validate(v); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, tenantIDKey{}, v), nil
+}
+`),
+					wantCode: 0,
+				},
+			} {
+				t.Run(tt.name, func(t *testing.T) {
 					runTest(t, tt)
 				})
 			}
 		})
-	})
+	})
+}
+
+// TestGeneratedCode compiles the generated code together with a test
+// in a temporary GOPATH and runs it with the race detector.
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b   string
+		want   int
+		wantOK bool
+	}{
+		{a: "v1.2.3", b: "v1.2.3", want: 0, wantOK: true},
+		{a: "v1.2.3", b: "v1.10.0", want: -1, wantOK: true},
+		{a: "v2.0.0", b: "v1.10.0", want: 1, wantOK: true},
+		{a: "v1.0.0-rc.1", b: "v1.0.0", want: -1, wantOK: true},
+		{a: "v1.0.0-rc.2", b: "v1.0.0-rc.10", want: -1, wantOK: true},
+		{a: "v1.0.0-rc.1", b: "v1.0.0-1", want: 1, wantOK: true},
+		{a: "v1.0.0-rc", b: "v1.0.0-rc.1", want: -1, wantOK: true},
+		{a: "v1.0.0+build.1", b: "v1.0.0", want: 0, wantOK: true},
+		{a: "v0.0.0-20250101000000-abcdef123456", b: "v0.0.1", want: -1, wantOK: true},
+		{a: "latest", b: "v1.0.0"},
+		{a: "v1.0", b: "v1.0.0"},
+		{a: "v1.0.0", b: "(devel)"},
+	} {
+		got, ok := compareVersions(tt.a, tt.b)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("compareVersions(%q, %q) = %v, %v, want %v, %v", tt.a, tt.b, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestGeneratedCode(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping compilation of the generated code in short mode")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skipf("go tool is not available: %v", err)
+	}
+
+	type gentest struct {
+		name string
+		// fields are passed to valctx with the -field flag.
+		fields []string
+		// goVersion is passed to valctx with the -go flag.
+		// The test is skipped if the go tool doesn't support it.
+		goVersion string
+		// args are additional valctx flags.
+		args []string
+		// test is the source of gen_test.go placed next to the generated file
+		// in the package "gen".
+		test string
+	}
+
+	runTest := func(t *testing.T, tt gentest) {
+		args := []string{"-package", "gen"}
+		if tt.goVersion != "" {
+			if !supportsGoVersion(tt.goVersion) {
+				t.Skipf("go tool doesn't support go%s", tt.goVersion)
+			}
+			args = append(args, "-go", tt.goVersion)
+		}
+		args = append(args, tt.args...)
+		gopath, err := ioutil.TempDir("", "valctx-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(gopath)
+		if err = copyRuntimePackage(gopath); err != nil {
+			t.Fatal(err)
+		}
+		dir := filepath.Join(gopath, "src", "valctxtest", "gen")
+
+		args = append(args, "-output", filepath.Join(dir, "ctx.go"))
+		for _, f := range tt.fields {
+			args = append(args, "-field", f)
+		}
+		stderr := &recordFile{}
+		code, err := run(context.Background(), args, ioutil.Discard, stderr, "", "", "", app.NewSafeFile)
+		if code != 0 || err != nil {
+			t.Fatalf("run() code = %v, err = %v, stderr = %s", code, err, stderr.Data.String())
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "gen_test.go"), []byte(tt.test), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testArgs := []string{"test", "-count=1"}
+		if os.Getenv("CGO_ENABLED") != "0" {
+			testArgs = append(testArgs, "-race")
+		}
+		cmd := exec.Command("go", append(testArgs, "valctxtest/gen")...)
+		cmd.Env = append(os.Environ(), "GOPATH="+gopath, "GO111MODULE=off", "GOFLAGS=")
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			generated, _ := ioutil.ReadFile(filepath.Join(dir, "ctx.go"))
+			t.Fatalf("go test: %v\n%s\ngenerated code:\n%s", err, out, generated)
+		}
+	}
+
+	for _, tt := range []gentest{
+		{
+			name:   "renamed field",
+			fields: []string{"TenantID:string,renamed-from=OrgID", "Data,renamed-from=Payload"},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRenamed(t *testing.T) {
+	ctx := context.WithValue(context.Background(), orgIDKey{}, "old")
+	if v, ok := GetTenantID(ctx); !ok || v != "old" {
+		t.Errorf("GetTenantID() = %q, %v; want value of the former key", v, ok)
+	}
+	ctx = SetOrgID(ctx, "new")
+	if v, ok := GetTenantID(ctx); !ok || v != "new" {
+		t.Errorf("GetTenantID() = %q, %v; want value set with the former setter", v, ok)
+	}
+	if v, ok := GetOrgID(ctx); !ok || v != "new" {
+		t.Errorf("GetOrgID() = %q, %v; want value of the new key", v, ok)
+	}
+
+	ctx = context.WithValue(context.Background(), payloadKey{}, 1)
+	if v := GetData(ctx); v != 1 {
+		t.Errorf("GetData() = %v; want value of the former key", v)
+	}
+	if v := GetPayload(SetData(ctx, 2)); v != 2 {
+		t.Errorf("GetPayload() = %v; want value of the new key", v)
+	}
+}
+`,
+		},
+		{
+			name: "set-once fields",
+			fields: []string{
+				"TenantID:string,set-once",
+				"Principal,set-once=panic,renamed-from=User",
+				"Actor,set-once",
+				"Limit:*int,set-once=panic,nil-is-absent=refuse",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetOnce(t *testing.T) {
+	ctx := context.Background()
+	if HasTenantID(ctx) {
+		t.Error("HasTenantID() = true on empty context")
+	}
+	ctx, err := SetTenantID(ctx, "first")
+	if err != nil {
+		t.Fatalf("SetTenantID() err = %v", err)
+	}
+	if !HasTenantID(ctx) {
+		t.Error("HasTenantID() = false after SetTenantID")
+	}
+	got, err := SetTenantID(ctx, "second")
+	if err != ErrTenantIDAlreadySet {
+		t.Errorf("SetTenantID() err = %v, want %v", err, ErrTenantIDAlreadySet)
+	}
+	if v, _ := GetTenantID(got); v != "first" {
+		t.Errorf("GetTenantID() = %q, want the first value", v)
+	}
+}
+
+func TestSetOnceNil(t *testing.T) {
+	ctx, err := SetActor(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("SetActor() err = %v", err)
+	}
+	if !HasActor(ctx) {
+		t.Error("HasActor() = false after SetActor(nil)")
+	}
+	if v := GetActor(ctx); v != nil {
+		t.Errorf("GetActor() = %v, want nil", v)
+	}
+	if _, err = SetActor(ctx, "second"); err != ErrActorAlreadySet {
+		t.Errorf("SetActor() err = %v, want %v", err, ErrActorAlreadySet)
+	}
+}
+
+func TestSetOncePanic(t *testing.T) {
+	ctx := SetUser(context.Background(), "first")
+	defer func() {
+		if r := recover(); r != ErrPrincipalAlreadySet {
+			t.Errorf("recover() = %v, want %v", r, ErrPrincipalAlreadySet)
+		}
+	}()
+	SetPrincipal(ctx, "second")
+	t.Error("SetPrincipal() did not panic")
+}
+
+func TestSetOncePanicRefusingNil(t *testing.T) {
+	if _, err := SetLimit(context.Background(), nil); err != ErrLimitIsNil {
+		t.Errorf("SetLimit(nil) err = %v, want %v", err, ErrLimitIsNil)
+	}
+	limit := 1
+	ctx, err := SetLimit(context.Background(), &limit)
+	if err != nil {
+		t.Fatalf("SetLimit() err = %v", err)
+	}
+	defer func() {
+		if r := recover(); r != ErrLimitAlreadySet {
+			t.Errorf("recover() = %v, want %v", r, ErrLimitAlreadySet)
+		}
+	}()
+	_, _ = SetLimit(ctx, &limit)
+	t.Error("SetLimit() did not panic")
+}
+`,
+		},
+		{
+			name: "copy fields",
+			fields: []string{
+				"TraceIDs:[]string,copy",
+				"Labels:map[string]string,copy",
+				"URL:*net/url.URL,copy",
+				"Tags:[]string,copy=set",
+				"Scopes:[]string,copy,set-once,nil-is-absent=get",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestCopyIsolation(t *testing.T) {
+	ids := []string{"a"}
+	labels := map[string]string{"k": "a"}
+	u := &url.URL{Host: "a"}
+	tags := []string{"a"}
+	ctx := SetTraceIDs(context.Background(), ids)
+	ctx = SetLabels(ctx, labels)
+	ctx = SetURL(ctx, u)
+	ctx = SetTags(ctx, tags)
+
+	// The caller keeps mutating its values after storing them.
+	ids[0], labels["k"], u.Host, tags[0] = "b", "b", "b", "b"
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids, _ := GetTraceIDs(ctx)
+			labels, _ := GetLabels(ctx)
+			u, _ := GetURL(ctx)
+			if ids[0] != "a" || labels["k"] != "a" || u.Host != "a" {
+				t.Errorf("got %q, %q, %q; want values stored in the context", ids[0], labels["k"], u.Host)
+			}
+			ids[0], labels["k"], u.Host = "c", "c", "c"
+		}()
+	}
+	wg.Wait()
+
+	if tags, _ := GetTags(ctx); tags[0] != "a" {
+		t.Errorf("GetTags() = %q, want value stored in the context", tags)
+	}
+	if ids, ok := GetTraceIDs(SetTraceIDs(ctx, nil)); ids != nil || !ok {
+		t.Errorf("GetTraceIDs() = %v, %v; want nil slice", ids, ok)
+	}
+}
+
+func TestCopyHas(t *testing.T) {
+	ctx, err := SetScopes(context.Background(), nil)
+	if err != nil || HasScopes(ctx) {
+		t.Fatalf("HasScopes() = %v, err = %v after SetScopes(nil)", HasScopes(ctx), err)
+	}
+	if ctx, err = SetScopes(ctx, []string{"read"}); err != nil || !HasScopes(ctx) {
+		t.Fatalf("HasScopes() = %v, err = %v after SetScopes()", HasScopes(ctx), err)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { HasScopes(ctx) }); allocs != 0 {
+		t.Errorf("HasScopes() allocates %v times, want no copy", allocs)
+	}
+}
+`,
+		},
+		{
+			name:   "lazy field",
+			fields: []string{"User:string,lazy", "Session,lazy"},
+			test: `package gen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLazy(t *testing.T) {
+	if _, ok, err := GetUser(context.Background()); ok || err != nil {
+		t.Errorf("GetUser() = %v, %v; want no loader", ok, err)
+	}
+
+	var calls int32
+	errLoad := errors.New("load")
+	ctx := SetUserLoader(context.Background(), func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "user", errLoad
+	})
+	ctx = SetSessionLoader(ctx, func() (interface{}, error) {
+		return 1, nil
+	})
+	ctx = context.WithValue(ctx, struct{}{}, "derived")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, ok, err := GetUser(ctx)
+			if v != "user" || !ok || err != errLoad {
+				t.Errorf("GetUser() = %q, %v, %v; want cached result", v, ok, err)
+			}
+			if v, ok, err := GetSession(ctx); v != 1 || !ok || err != nil {
+				t.Errorf("GetSession() = %v, %v, %v; want cached result", v, ok, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("loader is called %d times, want 1", calls)
+	}
+}
+
+func TestLazyNilLoader(t *testing.T) {
+	defer func() {
+		if r := recover(); r != "SetUserLoader: nil loader" {
+			t.Errorf("SetUserLoader(nil) panics with %v", r)
+		}
+	}()
+	SetUserLoader(context.Background(), nil)
+}
+`,
+		},
+		{
+			name:   "mutable field",
+			fields: []string{"Route:string,mutable"},
+			test: `package gen
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMutable(t *testing.T) {
+	if StoreRoute(context.Background(), "/") {
+		t.Error("StoreRoute() = true without holder")
+	}
+
+	ctx := InitRoute(context.Background())
+	if _, ok := LoadRoute(ctx); ok {
+		t.Error("LoadRoute() ok = true before StoreRoute")
+	}
+	if InitRoute(ctx) != ctx {
+		t.Error("InitRoute() replaced the installed holder")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			child, cancel := context.WithCancel(ctx)
+			defer cancel()
+			if !StoreRoute(child, strconv.Itoa(i)) {
+				t.Error("StoreRoute() = false with installed holder")
+			}
+			LoadRoute(child)
+		}(i)
+	}
+	wg.Wait()
+	if v, ok := LoadRoute(ctx); !ok || v == "" {
+		t.Errorf("LoadRoute() = %q, %v; want value stored by derived contexts", v, ok)
+	}
+}
+`,
+		},
+		{
+			name:   "append field",
+			fields: []string{"Breadcrumbs:string,append"},
+			test: `package gen
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	if v := GetBreadcrumbs(context.Background()); v != nil {
+		t.Errorf("GetBreadcrumbs() = %q, want nil", v)
+	}
+	parent := AppendBreadcrumbs(context.Background(), "a")
+	parent = AppendBreadcrumbs(parent, "b", "c")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			child := AppendBreadcrumbs(parent, "d")
+			if got := GetBreadcrumbs(child); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+				t.Errorf("GetBreadcrumbs(child) = %q", got)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := GetBreadcrumbs(parent); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("GetBreadcrumbs(parent) = %q", got)
+	}
+}
+`,
+		},
+		{
+			name:   "closer field",
+			fields: []string{"Resource:io.Closer,closer"},
+			test:   closerTest,
+		},
+		{
+			name:      "closer field with context.AfterFunc",
+			fields:    []string{"Resource:io.Closer,closer"},
+			goVersion: "1.21",
+			test:      closerTest,
+		},
+		{
+			name:   "ttl fields",
+			fields: []string{"Token:string,ttl,set-once", "Claims,ttl"},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	nowToken = func() time.Time { return now }
+	nowClaims = nowToken
+
+	ctx, err := SetTokenWithTTL(context.Background(), "token", time.Minute)
+	if err != nil {
+		t.Fatalf("SetTokenWithTTL() err = %v", err)
+	}
+	ctx = SetClaimsWithTTL(ctx, "claims", time.Minute)
+	if _, err = SetToken(ctx, "other"); err != ErrTokenAlreadySet {
+		t.Errorf("SetToken() err = %v, want %v", err, ErrTokenAlreadySet)
+	}
+	if v, ok := GetToken(ctx); !ok || v != "token" {
+		t.Errorf("GetToken() = %q, %v; want not expired value", v, ok)
+	}
+
+	now = now.Add(time.Minute)
+	if v, ok := GetToken(ctx); ok || v != "" {
+		t.Errorf("GetToken() = %q, %v; want expired value", v, ok)
+	}
+	if v := GetClaims(ctx); v != nil {
+		t.Errorf("GetClaims() = %v; want expired value", v)
+	}
+	if _, err = SetToken(ctx, "other"); err != nil {
+		t.Errorf("SetToken() err = %v; want expired value to be replaced", err)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if v := GetClaims(SetClaims(ctx, "claims")); v != "claims" {
+		t.Errorf("GetClaims() = %v; want value without expiry", v)
+	}
+}
+`,
+		},
+		{
+			name:   "untyped set-once ttl fields",
+			fields: []string{"Data,set-once,ttl", "Meta,set-once,ttl,renamed-from=Info,nil-is-absent"},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSetOnceTTL(t *testing.T) {
+	now := time.Now()
+	nowData = func() time.Time { return now }
+
+	ctx, err := SetDataWithTTL(context.Background(), nil, time.Minute)
+	if err != nil {
+		t.Fatalf("SetDataWithTTL() err = %v", err)
+	}
+	if !HasData(ctx) {
+		t.Error("HasData() = false after SetDataWithTTL(nil)")
+	}
+	if _, err = SetData(ctx, "other"); err != ErrDataAlreadySet {
+		t.Errorf("SetData() err = %v, want %v", err, ErrDataAlreadySet)
+	}
+	now = now.Add(time.Minute)
+	if HasData(ctx) {
+		t.Error("HasData() = true for expired value")
+	}
+	if _, err = SetData(ctx, "other"); err != nil {
+		t.Errorf("SetData() err = %v; want expired value to be replaced", err)
+	}
+}
+
+func TestSetOnceTTLRenamedNil(t *testing.T) {
+	ctx := context.WithValue(context.Background(), infoKey{}, "old")
+	if !HasMeta(ctx) {
+		t.Error("HasMeta() = false for value of former key")
+	}
+	ctx, err := SetMeta(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("SetMeta() err = %v", err)
+	}
+	if HasMeta(ctx) {
+		t.Error("HasMeta() = true for nil value")
+	}
+}
+`,
+		},
+		{
+			name: "nil-is-absent fields",
+			fields: []string{
+				"User:*net/url.Userinfo,nil-is-absent=refuse",
+				"Labels:map[string]string,nil-is-absent=drop",
+				"Parent:context.Context,nil-is-absent",
+				"Data,renamed-from=Payload",
+				"Count:int",
+			},
+			args: []string{"-nil-is-absent", "drop"},
+			test: `package gen
+
+import (
+	"context"
+	"net/url"
+	"testing"
+)
+
+func TestNilIsAbsent(t *testing.T) {
+	ctx := context.Background()
+	var user *url.Userinfo
+	if _, err := SetUser(ctx, user); err != ErrUserIsNil {
+		t.Errorf("SetUser() err = %v, want %v", err, ErrUserIsNil)
+	}
+	ctx = context.WithValue(ctx, userKey{}, user)
+	if _, ok := GetUser(ctx); ok {
+		t.Error("GetUser() ok = true for typed nil")
+	}
+
+	if got := SetLabels(ctx, nil); got != ctx {
+		t.Error("SetLabels() changed the context for nil map")
+	}
+
+	var parent context.Context
+	if _, ok := GetParent(SetParent(ctx, parent)); ok {
+		t.Error("GetParent() ok = true for nil interface")
+	}
+	if _, ok := GetParent(SetParent(ctx, ctx)); !ok {
+		t.Error("GetParent() ok = false for not nil interface")
+	}
+
+	// Data is affected by -nil-is-absent=drop.
+	if got := SetData(ctx, user); got != ctx {
+		t.Error("SetData() changed the context for typed nil")
+	}
+	ctx = context.WithValue(ctx, dataKey{}, user)
+	if v := GetData(ctx); v != nil {
+		t.Errorf("GetData() = %#v, want untyped nil", v)
+	}
+	if v, ok := GetCount(SetCount(ctx, 0)); !ok || v != 0 {
+		t.Errorf("GetCount() = %v, %v; want zero value", v, ok)
+	}
+}
+`,
+		},
+		{
+			name: "validated fields",
+			fields: []string{
+				"TenantID:string,validate=validateTenantID,set-once=panic",
+				"Data,validate=validateData",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+var errInvalid = errors.New("invalid")
+
+func validateTenantID(v string) error {
+	if !regexp.MustCompile("^[a-z0-9-]+$").MatchString(v) {
+		return errInvalid
+	}
+	return nil
+}
+
+func validateData(v interface{}) error {
+	if v == nil {
+		return errInvalid
+	}
+	return nil
+}
+
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+	if got, err := SetTenantID(ctx, "Tenant 1"); err != errInvalid || got != ctx {
+		t.Errorf("SetTenantID() = %v, %v; want validation error", got, err)
+	}
+	ctx, err := SetTenantID(ctx, "tenant-1")
+	if err != nil {
+		t.Fatalf("SetTenantID() err = %v", err)
+	}
+	if v, _ := GetTenantID(ctx); v != "tenant-1" {
+		t.Errorf("GetTenantID() = %q, want valid value", v)
+	}
+	if _, err = SetData(ctx, nil); err != errInvalid {
+		t.Errorf("SetData() err = %v, want validation error", err)
+	}
+}
+
+func TestValidateSetOncePanic(t *testing.T) {
+	ctx, err := SetTenantID(context.Background(), "tenant-1")
+	if err != nil {
+		t.Fatalf("SetTenantID() err = %v", err)
+	}
+	defer func() {
+		if r := recover(); r != ErrTenantIDAlreadySet {
+			t.Errorf("recover() = %v, want %v", r, ErrTenantIDAlreadySet)
+		}
+	}()
+	_, _ = SetTenantID(ctx, "tenant-2")
+	t.Error("SetTenantID() did not panic")
+}
+`,
+		},
+		{
+			name: "header fields",
+			fields: []string{
+				"TenantID:.TenantID,required,header=X-Tenant",
+				"RequestID:string,header=X-Request-ID,validate=validateRequestID",
+				"Locale:string,header=Accept-Language",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+type TenantID string
+
+var errInvalid = errors.New("invalid")
+
+func validateRequestID(v string) error {
+	if len(v) > 8 {
+		return errInvalid
+	}
+	return nil
+}
+
+func TestFromHeader(t *testing.T) {
+	ctx := context.Background()
+	h := http.Header{}
+	h.Set("X-Request-ID", "req-1")
+	if got, err := FromHeader(ctx, h); err != ErrTenantIDHeaderMissing || got != ctx {
+		t.Errorf("FromHeader() = %v, %v; want %v", got, err, ErrTenantIDHeaderMissing)
+	}
+	h.Set("X-Tenant", "tenant-1")
+	got, err := FromHeader(ctx, h)
+	if err != nil {
+		t.Fatalf("FromHeader() err = %v", err)
+	}
+	if v, ok := GetTenantID(got); !ok || v != "tenant-1" {
+		t.Errorf("GetTenantID() = %q, %v; want header value", v, ok)
+	}
+	if v, ok := GetRequestID(got); !ok || v != "req-1" {
+		t.Errorf("GetRequestID() = %q, %v; want header value", v, ok)
+	}
+	if _, ok := GetLocale(got); ok {
+		t.Error("GetLocale() ok = true for missing header")
+	}
+	h.Set("X-Request-ID", "request-1")
+	if got, err = FromHeader(ctx, h); err != errInvalid || got != ctx {
+		t.Errorf("FromHeader() = %v, %v; want validation error", got, err)
+	}
+}
+`,
+		},
+		{
+			name: "predeclared and local types",
+			fields: []string{
+				"Err:error,nil-is-absent",
+				"Session:.Session",
+				"Resource:*.resource,closer",
+				"Current:*.Session,copy=get",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+type Session struct {
+	ID string
+}
+
+type resource struct {
+	closed bool
+}
+
+func (r *resource) Close() error {
+	r.closed = true
+	return nil
+}
+
+type customError struct{}
+
+func (*customError) Error() string { return "custom" }
+
+func TestTypes(t *testing.T) {
+	var err *customError
+	ctx := SetErr(context.Background(), err)
+	if _, ok := GetErr(ctx); ok {
+		t.Error("GetErr() ok = true for typed nil error")
+	}
+	ctx = SetSession(ctx, Session{ID: "id"})
+	if v, ok := GetSession(ctx); !ok || v.ID != "id" {
+		t.Errorf("GetSession() = %v, %v; want stored value", v, ok)
+	}
+	r := &resource{}
+	ctx, stop := SetResource(ctx, r)
+	defer stop()
+	if v, ok := GetResource(ctx); !ok || v != r {
+		t.Errorf("GetResource() = %p, %v; want %p", v, ok, r)
+	}
+	stop()
+	s := &Session{ID: "current"}
+	ctx = SetCurrent(ctx, s)
+	if v, ok := GetCurrent(ctx); !ok || v == s || v.ID != s.ID {
+		t.Errorf("GetCurrent() = %p, %v; want copy of %p", v, ok, s)
+	}
+}
+`,
+		},
+		{
+			name:      "generic types",
+			goVersion: "1.18",
+			fields: []string{
+				"Value:.Option[string],nil-is-absent",
+				"Pairs:map[string].Pair[int, *.Option[string]],copy",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+type Option[T any] interface {
+	Get() (T, bool)
+}
+
+type some[T any] struct {
+	v T
+}
+
+func (s some[T]) Get() (T, bool) { return s.v, true }
+
+type Pair[K comparable, V any] struct {
+	Key   K
+	Value V
+}
+
+func TestGeneric(t *testing.T) {
+	var o Option[string] = some[string]{v: "value"}
+	ctx := SetValue(context.Background(), o)
+	if v, ok := GetValue(ctx); !ok || v != o {
+		t.Errorf("GetValue() = %v, %v; want %v", v, ok, o)
+	}
+	if _, ok := GetValue(SetValue(ctx, nil)); ok {
+		t.Error("GetValue() ok = true for nil value")
+	}
+	pairs := map[string]Pair[int, *Option[string]]{"one": {Key: 1, Value: &o}}
+	ctx = SetPairs(ctx, pairs)
+	pairs["two"] = Pair[int, *Option[string]]{Key: 2}
+	if v, ok := GetPairs(ctx); !ok || len(v) != 1 || v["one"].Value != &o {
+		t.Errorf("GetPairs() = %v, %v; want copy of the set value", v, ok)
+	}
+}
+`,
+		},
+		{
+			name:      "go 1.22 target",
+			goVersion: "1.22",
+			fields: []string{
+				"UserID",
+				"Attrs:map[string]string,copy",
+				"Tags:string,append",
+			},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+func TestStdHelpers(t *testing.T) {
+	ctx := SetUserID(context.Background(), 1)
+	if v := GetUserID(ctx); v != any(1) {
+		t.Errorf("GetUserID() = %v; want 1", v)
+	}
+	attrs := map[string]string{"a": "1"}
+	ctx = SetAttrs(ctx, attrs)
+	attrs["b"] = "2"
+	if v, ok := GetAttrs(ctx); !ok || len(v) != 1 {
+		t.Errorf("GetAttrs() = %v, %v; want copy of the set value", v, ok)
+	}
+	if v, _ := GetAttrs(SetAttrs(ctx, nil)); v != nil {
+		t.Errorf("GetAttrs() = %v; want nil", v)
+	}
+	ctx = AppendTags(AppendTags(ctx, "a"), "b", "c")
+	if v := GetTags(ctx); len(v) != 3 || v[0] != "a" || v[2] != "c" {
+		t.Errorf("GetTags() = %v; want [a b c]", v)
+	}
+}
+`,
+		},
+		{
+			name:      "runtime keys",
+			goVersion: "1.18",
+			fields:    []string{"UserID:string", "Breadcrumbs:string,append"},
+			args:      []string{"-runtime-keys"},
+			test: `package gen
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRuntimeKeys(t *testing.T) {
+	ctx := UserIDKey.Set(context.Background(), "set with key")
+	if v, ok := GetUserID(ctx); !ok || v != "set with key" {
+		t.Errorf("GetUserID() = %q, %v; want value set with the key", v, ok)
+	}
+	ctx = SetUserID(ctx, "set with setter")
+	if v := UserIDKey.Must(ctx); v != "set with setter" {
+		t.Errorf("UserIDKey.Must() = %q; want value set with the setter", v)
+	}
+	if v := GetBreadcrumbs(AppendBreadcrumbs(ctx, "a")); len(v) != 1 {
+		t.Errorf("GetBreadcrumbs() = %v; want [a]", v)
+	}
+}
+`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			runTest(t, tt)
+		})
+	}
+}
+
+const closerTest = `package gen
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type closer struct {
+	n      int32
+	closed chan struct{}
+}
+
+func (c *closer) Close() error {
+	if atomic.AddInt32(&c.n, 1) == 1 {
+		close(c.closed)
+	}
+	return nil
+}
+
+func TestCloserCancel(t *testing.T) {
+	c := &closer{closed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, stop := SetResource(ctx, c)
+	if v, ok := GetResource(ctx); !ok || v != c {
+		t.Errorf("GetResource() = %v, %v; want the resource", v, ok)
+	}
+	cancel()
+	cancel()
+	select {
+	case <-c.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resource is not closed after cancel")
+	}
+	if stop() {
+		t.Error("stop() = true after the resource is closed")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&c.n); n != 1 {
+		t.Errorf("resource is closed %d times, want 1", n)
+	}
+}
+
+func TestCloserStop(t *testing.T) {
+	c := &closer{closed: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, stop := SetResource(ctx, c)
+	if !stop() {
+		t.Error("stop() = false before cancel")
+	}
+	if stop() {
+		t.Error("stop() = true on the second call")
+	}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&c.n); n != 0 {
+		t.Errorf("resource is closed %d times after stop, want 0", n)
+	}
+
+	_, stop = SetResource(context.Background(), c)
+	if !stop() {
+		t.Error("stop() = false for the context that is never done")
+	}
+}
+
+func TestCloserNil(t *testing.T) {
+	for _, v := range []io.Closer{nil, (*closer)(nil)} {
+		ctx, cancel := context.WithCancel(context.Background())
+		_, stop := SetResource(ctx, v)
+		cancel()
+		time.Sleep(10 * time.Millisecond)
+		if stop() {
+			t.Errorf("stop() = true for nil %T", v)
+		}
+	}
+}
+`
+
+// copyRuntimePackage copies the valctx package, imported by the code generated
+// with runtime keys, to the gopath.
+func copyRuntimePackage(gopath string) error {
+	files, err := filepath.Glob(filepath.Join("..", "..", "*.go"))
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(gopath, "src", filepath.FromSlash(gen.RuntimePackage))
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, filepath.Base(file)), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func supportsGoVersion(v string) bool {
+	for _, tag := range build.Default.ReleaseTags {
+		if tag == "go"+v {
+			return true
+		}
+	}
+	return false
 }
 
 type recordFile struct {
@@ -513,6 +2835,12 @@ func (m *mockFile) WithRename() {
 	m.withRenameFn()
 }
 
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
+
 func devnull(_ string) (io.WriteCloser, error) {
 	return discardFile{}, nil
 }
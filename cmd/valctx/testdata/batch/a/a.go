@@ -0,0 +1,3 @@
+package a
+
+//valctx:generate -output ctx.go -field UserID:string
@@ -0,0 +1,6 @@
+//go:build ignore
+// +build ignore
+
+package a
+
+//valctx:generate -output ignored_ctx.go -field UserID:string
@@ -0,0 +1,5 @@
+package b
+
+//valctx:generate -output=gen/ctx.go -package gen \
+//  -field 'TraceIDs:[]string' \
+//  -field Tags:string,append
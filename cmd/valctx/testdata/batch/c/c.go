@@ -0,0 +1,3 @@
+package c
+
+//valctx:generate -output ctx.go -field 'bad name'
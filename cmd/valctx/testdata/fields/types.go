@@ -0,0 +1,4 @@
+package fields
+
+//valctx:field TenantID,required,header=X-Tenant
+type TenantID string
@@ -0,0 +1,17 @@
+// Package valctx provides typed context keys usable without code generation.
+//
+// A Key is created once, usually as a package-level variable, and then used
+// to set and retrieve values of its type:
+//
+//	var UserIDKey = valctx.NewKey[string]("UserID")
+//
+//	ctx = UserIDKey.Set(ctx, "42")
+//	id, ok := UserIDKey.Get(ctx)
+//
+// Each Key stores its values under a pointer allocated by NewKey, and pointers are
+// compared by identity, so keys never collide, even keys with the same name and type.
+// The code generated with the -runtime-keys flag wraps Keys, so hand-written
+// and generated code share the same values.
+//
+// Keys require Go 1.18 or later.
+package valctx
@@ -0,0 +1,280 @@
+package gen
+
+import (
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Check parses and type-checks the source generated for the package and the fields,
+// replacing non-standard packages and local types with stubs, see stubPackage.
+// It returns *StdImportError if the installed Go can't provide the standard packages.
+func Check(filename string, src []byte, pkg Package, fields []Field) error {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("generated code is invalid: %v", err)
+	}
+	if !supportsGoVersion(pkg.GoVersion) {
+		return nil
+	}
+	err = typeCheck(fset, file, pkg, fields)
+	if _, ok := err.(*StdImportError); ok {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("generated code is invalid: %v", err)
+	}
+	return nil
+}
+
+// StdImportError is returned by Check if the installed Go can't provide the standard packages,
+// e.g. without their export data, so the source is parsed but not type-checked.
+type StdImportError struct {
+	Err error
+}
+
+func (e *StdImportError) Error() string {
+	return fmt.Sprintf("standard packages can't be imported: %v", e.Err)
+}
+
+// supportsGoVersion reports whether go/types of the Go valctx is built with
+// supports the language features of v.
+func supportsGoVersion(v GoVersion) bool {
+	for _, tag := range build.Default.ReleaseTags {
+		if tag == "go"+v.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func typeCheck(fset *token.FileSet, file *ast.File, pkg Package, fields []Field) error {
+	imports := map[string]string{} // package name to import path
+	for _, spec := range file.Imports {
+		path, _ := strconv.Unquote(spec.Path.Value)
+		name := PackageName(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	stubs := map[string]*stubPackage{}
+	local := &stubPackage{name: pkg.PackageName}
+	// stubOf returns the stub package declaring the name referred to by expr,
+	// or nil for predeclared names and names of standard packages.
+	stubOf := func(expr ast.Expr) (*stubPackage, string) {
+		switch x := expr.(type) {
+		case *ast.Ident:
+			if !isPredeclared(x.Name) {
+				return local, x.Name
+			}
+		case *ast.SelectorExpr:
+			id, ok := x.X.(*ast.Ident)
+			if !ok {
+				return nil, ""
+			}
+			path, ok := imports[id.Name]
+			if !ok || isStandardPackage(path) || path == RuntimePackage {
+				return nil, ""
+			}
+			if stubs[path] == nil {
+				stubs[path] = &stubPackage{name: PackageName(path)}
+			}
+			return stubs[path], x.Sel.Name
+		}
+		return nil, ""
+	}
+	var declareTypes func(n ast.Node) bool
+	declareTypes = func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.Ident, *ast.SelectorExpr:
+			if stub, name := stubOf(x.(ast.Expr)); stub != nil {
+				stub.addType(name, 0)
+			}
+			return false
+		case *ast.Field:
+			ast.Inspect(x.Type, declareTypes)
+			return false
+		}
+		if x, args, ok := typeArgs(exprOf(n)); ok {
+			if stub, name := stubOf(x); stub != nil {
+				stub.addType(name, len(args))
+			}
+			for _, arg := range args {
+				ast.Inspect(arg, declareTypes)
+			}
+			return false
+		}
+		return true
+	}
+	for _, f := range fields {
+		expr, err := parser.ParseExpr(f.FieldType)
+		if err != nil {
+			return err
+		}
+		ast.Inspect(expr, declareTypes)
+		if f.Header != "" {
+			// Header values are converted to the field type.
+			if stub, name := stubOf(expr); stub != nil {
+				stub.addStringType(name)
+			}
+		}
+		if f.Validator != "" {
+			validator, err := parser.ParseExpr(f.Validator)
+			if err != nil {
+				return err
+			}
+			if stub, name := stubOf(validator); stub != nil {
+				stub.addFunc(name)
+			}
+		}
+	}
+
+	files := []*ast.File{file}
+	if len(local.decls) > 0 {
+		stubFile, err := local.parse(fset)
+		if err != nil {
+			return err
+		}
+		files = append(files, stubFile)
+	}
+	importer := &stubImporter{fset: fset, stubs: stubs}
+	conf := types.Config{Importer: importer}
+	_, err := conf.Check(pkg.PackageName, fset, files, nil)
+	if importer.stdErr != nil {
+		return &StdImportError{Err: importer.stdErr}
+	}
+	return err
+}
+
+// exprOf returns n if it is an expression.
+func exprOf(n ast.Node) ast.Expr {
+	expr, _ := n.(ast.Expr)
+	return expr
+}
+
+func isPredeclared(name string) bool {
+	return types.Universe.Lookup(name) != nil
+}
+
+// isStandardPackage reports whether the import path belongs to the standard library,
+// whose first path element has no dot.
+func isStandardPackage(path string) bool {
+	return !strings.Contains(strings.SplitN(path, "/", 2)[0], ".")
+}
+
+// stubPackage declares the names used by the generated code:
+// types with a Close method, generic with any type parameters, and functions
+// of any argument returning error, like validators. The types of header fields
+// are strings. So a closer type without Close or a validator with a wrong signature
+// is not caught by Check.
+type stubPackage struct {
+	name  string
+	decls map[string]string
+}
+
+func (p *stubPackage) addType(name string, arity int) {
+	if _, ok := p.decls[name]; ok && arity == 0 {
+		return
+	}
+	params, args := "", ""
+	if arity > 0 {
+		names := make([]string, arity)
+		for i := range names {
+			names[i] = fmt.Sprintf("T%d", i)
+		}
+		params = "[" + strings.Join(names, ", ") + " any]"
+		args = "[" + strings.Join(names, ", ") + "]"
+	}
+	p.add(name, fmt.Sprintf("type %s%s struct{}\n\nfunc (%s%s) Close() error { return nil }\n", name, params, name, args))
+}
+
+// addStringType declares a type of string kind, replacing the declaration of addType.
+func (p *stubPackage) addStringType(name string) {
+	p.add(name, fmt.Sprintf("type %s string\n\nfunc (%s) Close() error { return nil }\n", name, name))
+}
+
+func (p *stubPackage) addFunc(name string) {
+	p.add(name, fmt.Sprintf("func %s(interface{}) error { return nil }\n", name))
+}
+
+func (p *stubPackage) add(name, decl string) {
+	if p.decls == nil {
+		p.decls = map[string]string{}
+	}
+	p.decls[name] = decl
+}
+
+func (p *stubPackage) parse(fset *token.FileSet) (*ast.File, error) {
+	names := make([]string, 0, len(p.decls))
+	for name := range p.decls {
+		names = append(names, name)
+	}
+	sort.Sort(sort.StringSlice(names))
+	src := "package " + p.name + "\n"
+	for _, name := range names {
+		src += "\n" + p.decls[name]
+	}
+	return parser.ParseFile(fset, "stub_"+p.name+".go", src, 0)
+}
+
+// runtimeStub declares the part of the runtime package used by the generated code.
+const runtimeStub = `package valctx
+
+import "context"
+
+type Key[T any] struct{}
+
+func NewKey[T any](name string) Key[T] { return Key[T]{} }
+
+func (k Key[T]) Get(ctx context.Context) (v T, ok bool) { return v, false }
+
+func (k Key[T]) Set(ctx context.Context, v T) context.Context { return ctx }
+`
+
+// stubImporter imports standard packages from the installed Go and stubs of other packages.
+type stubImporter struct {
+	fset  *token.FileSet
+	stubs map[string]*stubPackage
+	// stdErr is the error of importing a standard package.
+	stdErr error
+}
+
+var (
+	stdImporterMu sync.Mutex
+	stdImporter   = importer.Default()
+)
+
+func (i *stubImporter) Import(path string) (*types.Package, error) {
+	var (
+		file *ast.File
+		err  error
+	)
+	switch stub, ok := i.stubs[path]; {
+	case ok:
+		file, err = stub.parse(i.fset)
+	case path == RuntimePackage:
+		file, err = parser.ParseFile(i.fset, "stub_valctx.go", runtimeStub, 0)
+	default:
+		stdImporterMu.Lock()
+		defer stdImporterMu.Unlock()
+		pkg, err := stdImporter.Import(path)
+		if err != nil && i.stdErr == nil {
+			i.stdErr = err
+		}
+		return pkg, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	conf := types.Config{Importer: i}
+	return conf.Check(path, i.fset, []*ast.File{file}, nil)
+}
@@ -1,13 +1,18 @@
 package gen
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"go/ast"
+	"go/format"
 	"go/parser"
+	"go/token"
 	"io"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"unicode"
@@ -15,16 +20,347 @@ import (
 )
 
 type Field struct {
+	Kind      Kind
 	FieldName string
 	FieldType string
 	KeyName   string
+	// OldFieldName and OldKeyName are set for renamed fields
+	// to generate deprecated accessors with the former name.
+	OldFieldName string
+	OldKeyName   string
+	SetOnce      SetOnce
+	Copy         Copy
+	// Closer field values are closed when the context is done.
+	Closer bool
+	// TTL field values may be set with an expiry time.
+	TTL bool
+	Nil NilPolicy
+	// Validator is the function func(FieldType) error the setter checks values with,
+	// either a function of the generated package or an imported one in pkg.Func format.
+	Validator string
+	// Header is the HTTP header FromHeader sets the field from, if not empty.
+	Header string
+	// HeaderRequired makes FromHeader fail if the Header is missing.
+	HeaderRequired bool
 
 	// not used in the go template
-	pkg string
+	pkgs         []string
+	importNames  map[string]string
+	locals       []string
+	validatorPkg string
+	goVersion    GoVersion
 }
 
-func (f *Field) SetPackage(pkg string) {
-	f.pkg = pkg
+// Kind defines what accessors are generated for the field.
+type Kind int
+
+const (
+	// KindValue field is stored as is with Get and Set accessors.
+	KindValue Kind = iota
+	// KindLazy field is computed by a loader on first access with Get and SetLoader accessors.
+	KindLazy
+	// KindMutable field is stored in a holder updated in place with Init, Store and Load accessors.
+	KindMutable
+	// KindAppend field is a list of FieldType values accumulated with Append and read with Get accessors.
+	KindAppend
+	// KindKey field is stored with an exported valctx.Key wrapped by Get and Set accessors.
+	KindKey
+)
+
+// RuntimePackage is the import path of the package providing the keys of KindKey fields.
+const RuntimePackage = "github.com/hightech-ninja/valctx"
+
+// SetOnce controls how the setter treats a value already set in the context.
+type SetOnce int
+
+const (
+	// SetOnceNone setter overrides the value.
+	SetOnceNone SetOnce = iota
+	// SetOnceError setter returns an error if the value is already set.
+	SetOnceError
+	// SetOncePanic setter panics if the value is already set.
+	SetOncePanic
+)
+
+// Copy controls when the field accessors copy the value.
+type Copy int
+
+const (
+	// CopyNone accessors share the value.
+	CopyNone Copy = iota
+	// CopyOnSet setter stores a copy of the value.
+	CopyOnSet
+	// CopyOnGet getter returns a copy of the value.
+	CopyOnGet
+	// CopyAlways both setter and getter copy the value.
+	CopyAlways
+)
+
+// CopiesOnSet reports whether the field setter stores a copy of the value.
+func (f *Field) CopiesOnSet() bool {
+	return f.Copy == CopyOnSet || f.Copy == CopyAlways
+}
+
+// CopiesOnGet reports whether the field getter returns a copy of the value.
+func (f *Field) CopiesOnGet() bool {
+	return f.Copy == CopyOnGet || f.Copy == CopyAlways
+}
+
+// CopyKind returns the kind of the field type for copying: "slice", "map", "pointer"
+// or empty string if values of the type can't be copied by the generated code.
+func (f *Field) CopyKind() string {
+	expr, err := parser.ParseExpr(f.FieldType)
+	if err != nil {
+		return ""
+	}
+	switch t := expr.(type) {
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return "slice"
+		}
+	case *ast.MapType:
+		return "map"
+	case *ast.StarExpr:
+		return "pointer"
+	}
+	return ""
+}
+
+// UnexportedName returns the unexported name of a field-specific declaration.
+func (f *Field) UnexportedName(suffix string) string {
+	r, size := utf8.DecodeRuneInString(f.FieldName)
+	return string(unicode.ToLower(r)) + f.FieldName[size:] + suffix
+}
+
+// NilPolicy controls how the field accessors treat nil values.
+type NilPolicy int
+
+const (
+	// NilAllowed nil values are regular values.
+	NilAllowed NilPolicy = iota
+	// NilIsAbsent getter reports nil values as absent.
+	NilIsAbsent
+	// NilDropped getter reports nil values as absent, setter ignores them.
+	NilDropped
+	// NilRefused getter reports nil values as absent, setter returns an error for them.
+	NilRefused
+)
+
+// NilKind returns how nil values of the field type are detected: "compare" for types
+// comparable with nil, "reflect" for interfaces and named types that may be nilable,
+// or empty string for types that can't be nil.
+func (f *Field) NilKind() string {
+	if f.IsAny() {
+		return "reflect"
+	}
+	expr, err := parser.ParseExpr(f.FieldType)
+	if err != nil {
+		return ""
+	}
+	switch t := expr.(type) {
+	case *ast.ArrayType:
+		if t.Len == nil {
+			return "compare"
+		}
+	case *ast.MapType, *ast.StarExpr, *ast.ChanType, *ast.FuncType:
+		return "compare"
+	case *ast.SelectorExpr:
+		return "reflect"
+	case *ast.Ident:
+		if t.Name == "error" || f.isLocalType(t.Name) {
+			return "reflect"
+		}
+	default:
+		if _, _, ok := typeArgs(expr); ok {
+			return "reflect"
+		}
+	}
+	return ""
+}
+
+// DropsNil reports whether the field setter ignores nil values.
+func (f *Field) DropsNil() bool {
+	return f.Nil == NilDropped
+}
+
+// RefusesNil reports whether the field setter returns an error for nil values.
+func (f *Field) RefusesNil() bool {
+	return f.Nil == NilRefused
+}
+
+// UsesIsNil reports whether nil values are checked with reflection by the generated isNil function.
+func (f *Field) UsesIsNil() bool {
+	return (f.Nil != NilAllowed || f.Closer) && f.NilKind() == "reflect"
+}
+
+// NilCheck returns the expression reporting whether v is nil.
+func (f *Field) NilCheck() string {
+	if f.NilKind() == "reflect" {
+		return "isNil" + f.FieldName + "(v)"
+	}
+	return "v == nil"
+}
+
+// IsAny reports whether the field has no specific type.
+func (f *Field) IsAny() bool {
+	return f.FieldType == "interface{}" || f.FieldType == "any"
+}
+
+// GetterResults returns the result list of the field getter.
+func (f *Field) GetterResults() string {
+	if f.IsAny() {
+		return f.FieldType
+	}
+	return "(" + f.FieldType + ", bool)"
+}
+
+// UsesAfterFunc reports whether the closer field setter uses context.AfterFunc
+// instead of a goroutine watching the context.
+func (f *Field) UsesAfterFunc() bool {
+	return f.goVersion.AtLeast(1, 21)
+}
+
+// UsesStdClone reports whether the field copies values with slices.Clone or maps.Clone.
+func (f *Field) UsesStdClone() bool {
+	kind := f.CopyKind()
+	return f.Copy != CopyNone && (kind == "slice" || kind == "map") && f.goVersion.AtLeast(1, 21)
+}
+
+// UsesStdConcat reports whether the append field concatenates values with slices.Concat.
+func (f *Field) UsesStdConcat() bool {
+	return f.Kind == KindAppend && f.goVersion.AtLeast(1, 22)
+}
+
+// Imports returns the packages used by the generated accessors of the field,
+// except the context package and the package of the field type.
+func (f *Field) Imports() []string {
+	var imports []string
+	if f.Kind == KindKey {
+		imports = append(imports, RuntimePackage)
+	}
+	if f.UsesStdClone() && f.CopyKind() == "map" {
+		imports = append(imports, "maps")
+	}
+	if f.UsesStdClone() && f.CopyKind() == "slice" || f.UsesStdConcat() {
+		imports = append(imports, "slices")
+	}
+	if f.SetOnce != SetOnceNone {
+		imports = append(imports, "errors")
+	}
+	if f.Kind == KindLazy || f.Kind == KindMutable || f.Closer && !f.UsesAfterFunc() {
+		imports = append(imports, "sync")
+	}
+	if f.TTL {
+		imports = append(imports, "time")
+	}
+	if f.Nil == NilRefused && f.SetOnce == SetOnceNone {
+		imports = append(imports, "errors")
+	}
+	if f.UsesIsNil() {
+		imports = append(imports, "reflect")
+	}
+	if f.Header != "" {
+		imports = append(imports, "net/http")
+	}
+	if f.HeaderRequired {
+		imports = append(imports, "errors")
+	}
+	return imports
+}
+
+// StoredValue returns the expression of the value stored in the context by the setter.
+func (f *Field) StoredValue() string {
+	if f.TTL {
+		return f.UnexportedName("Entry") + "{v: v, expires: expires}"
+	}
+	if f.MarksNil() {
+		return "stored"
+	}
+	return "v"
+}
+
+// MarksNil reports whether the set-once setter stores a marker instead of the nil value,
+// which the context can't tell from an absent one, so that Has reports it as set.
+func (f *Field) MarksNil() bool {
+	return f.SetOnce != SetOnceNone && !f.TTL && f.IsAny()
+}
+
+// SetOncePanics reports whether the field setter panics if the value is already set,
+// even if it returns errors for other reasons.
+func (f *Field) SetOncePanics() bool {
+	return f.SetOnce == SetOncePanic
+}
+
+// SetterReturnsError reports whether the field setter may fail.
+func (f *Field) SetterReturnsError() bool {
+	return f.SetOnce == SetOnceError || f.Nil == NilRefused || f.Validator != ""
+}
+
+// SetterResults returns the result list of the field setter.
+func (f *Field) SetterResults() string {
+	if f.Closer {
+		return "(context.Context, func() bool)"
+	}
+	if f.SetterReturnsError() {
+		return "(context.Context, error)"
+	}
+	return "context.Context"
+}
+
+// HeaderValue returns the expression of the field value read from the header value v.
+func (f *Field) HeaderValue() string {
+	if f.FieldType == "string" {
+		return "v"
+	}
+	return f.FieldType + "(v)"
+}
+
+// SetPackages sets the import paths of the packages the field type refers to.
+func (f *Field) SetPackages(pkgs ...string) {
+	f.pkgs = pkgs
+}
+
+// SetImportNames sets the names of the packages the field refers to, which are imported
+// with a name other than PackageName, see Package.ImportNames.
+func (f *Field) SetImportNames(names map[string]string) {
+	f.importNames = names
+}
+
+// packageName returns the name the field refers to the package with the import path.
+func (f *Field) packageName(path string) string {
+	if name, ok := f.importNames[path]; ok {
+		return name
+	}
+	return PackageName(path)
+}
+
+// SetLocalTypes sets the names of the types declared in the generated package
+// the field type refers to.
+func (f *Field) SetLocalTypes(names ...string) {
+	f.locals = names
+}
+
+// LocalTypes returns the names of the types declared in the generated package
+// the field type refers to.
+func (f *Field) LocalTypes() []string {
+	return f.locals
+}
+
+func (f *Field) isLocalType(name string) bool {
+	for _, l := range f.locals {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Field) SetValidatorPackage(pkg string) {
+	f.validatorPkg = pkg
+}
+
+func (f *Field) SetGoVersion(v GoVersion) {
+	f.goVersion = v
 }
 
 func (f *Field) Validate() error {
@@ -34,27 +370,345 @@ func (f *Field) Validate() error {
 	if !isValidIdentifier(f.KeyName) {
 		return errors.New("invalid key name")
 	}
+	if f.OldFieldName != "" || f.OldKeyName != "" {
+		if !isValidIdentifier(f.OldFieldName) || f.OldFieldName == f.FieldName {
+			return errors.New("invalid former name")
+		}
+		if !isValidIdentifier(f.OldKeyName) || f.OldKeyName == f.KeyName {
+			return errors.New("invalid former key name")
+		}
+	}
 
-	if f.pkg != "" { // exported field
-		if !isValidImportPath(f.pkg) {
-			return errors.New("invalid package name")
+	switch f.Kind {
+	case KindValue:
+	case KindKey:
+		if !f.goVersion.AtLeast(1, 18) {
+			return errors.New("runtime keys require go 1.18 or later")
 		}
-		if !isValidImportedStruct(f.FieldType) {
-			return errors.New("invalid type")
+		if f.hasOptions() {
+			return errors.New("runtime key field doesn't support options")
 		}
-	} else { // built-in field
-		tr, err := parser.ParseExpr(f.FieldType)
-		if err != nil {
-			return fmt.Errorf("go parser: %v", err)
+	case KindLazy, KindMutable, KindAppend:
+		if f.hasOptions() {
+			return errors.New("field of this kind doesn't support other options")
 		}
-		// printExpr(tr)
-		if !isBuiltInType(tr) {
+	default:
+		return errors.New("invalid kind")
+	}
+	if f.SetOnce < SetOnceNone || f.SetOnce > SetOncePanic {
+		return errors.New("invalid set-once mode")
+	}
+
+	if f.Copy < CopyNone || f.Copy > CopyAlways {
+		return errors.New("invalid copy mode")
+	}
+	if f.Copy != CopyNone && f.CopyKind() == "" {
+		return errors.New("copy requires a slice, map or pointer type")
+	}
+	if f.Closer {
+		if !f.isNamedType() {
+			return errors.New("closer requires a type implementing io.Closer")
+		}
+		if f.SetOnce != SetOnceNone || f.Copy != CopyNone {
+			return errors.New("closer field can't be set-once or copied")
+		}
+	}
+	if f.Nil < NilAllowed || f.Nil > NilRefused {
+		return errors.New("invalid nil policy")
+	}
+	if f.Nil != NilAllowed && f.NilKind() == "" {
+		return errors.New("nil-is-absent requires a pointer, map, slice, channel, function or interface type")
+	}
+	if f.Closer && f.Nil > NilIsAbsent {
+		return errors.New("closer field setter can't drop or refuse nil values")
+	}
+	if f.Validator != "" {
+		if f.Closer {
+			return errors.New("closer field setter can't be validated")
+		}
+		if f.validatorPkg != "" {
+			if !isValidImportPath(f.validatorPkg) || !isValidImportedStruct(f.Validator) {
+				return errors.New("invalid validator")
+			}
+		} else if !isValidIdentifier(f.Validator) {
+			return errors.New("invalid validator")
+		} else if isLocalName(f.Validator) {
+			return fmt.Errorf("validator %s is shadowed by a variable of the generated code", f.Validator)
+		}
+	}
+	if f.Header != "" {
+		if !isValidHeader(f.Header) {
+			return errors.New("invalid header name")
+		}
+		if f.Closer {
+			return errors.New("closer field can't be set from a header")
+		}
+		if !f.isHeaderType() {
+			return errors.New("header requires the string type or a type of the generated package")
+		}
+	}
+	if f.HeaderRequired && f.Header == "" {
+		return errors.New("required requires a header")
+	}
+	if err := f.goVersion.Validate(); err != nil {
+		return err
+	}
+
+	for _, pkg := range f.pkgs {
+		if !isValidImportPath(pkg) {
+			return errors.New("invalid package name")
+		}
+		if !isValidIdentifier(PackageName(pkg)) {
+			return fmt.Errorf("last element of import path %q is not a valid package name", pkg)
+		}
+	}
+	for _, name := range f.locals {
+		if !isValidIdentifier(name) {
 			return errors.New("invalid type")
 		}
 	}
+	// Parsers of Go before 1.18 fail on type arguments, check the target version first.
+	if !f.goVersion.AtLeast(1, 18) && hasTypeArgs(f.FieldType) {
+		return errGenericTypes
+	}
+	tr, err := parser.ParseExpr(f.FieldType)
+	if err != nil {
+		return fmt.Errorf("go parser: %v", err)
+	}
+	// printExpr(tr)
+	c := typeChecker{field: f}
+	if !c.check(tr) {
+		return errors.New("invalid type")
+	}
+	if c.generic && !f.goVersion.AtLeast(1, 18) {
+		return errGenericTypes
+	}
+	if usesIdent(tr, "any") && !f.goVersion.AtLeast(1, 18) {
+		return errors.New("any requires go 1.18 or later")
+	}
 	return nil
 }
 
+var errGenericTypes = errors.New("generic types require -go 1.18 or later")
+
+// hasTypeArgs reports whether the type in go-code format instantiates a generic type,
+// that is, has brackets following a type name rather than starting an array, slice, map or channel element type.
+func hasTypeArgs(typ string) bool {
+	for i, r := range typ {
+		if r != '[' {
+			continue
+		}
+		before := strings.TrimRightFunc(typ[:i], unicode.IsSpace)
+		start := strings.LastIndexFunc(before, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_'
+		})
+		if name := before[start+1:]; name != "" && name != "map" && name != "chan" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOptions reports whether the field has options changing the accessors of KindValue fields.
+func (f *Field) hasOptions() bool {
+	return f.OldFieldName != "" || f.SetOnce != SetOnceNone || f.Copy != CopyNone || f.Closer || f.TTL ||
+		f.Nil != NilAllowed || f.Validator != "" || f.Header != "" || f.HeaderRequired
+}
+
+// isNamedType reports whether the field type is a named type, or a pointer to it,
+// of an imported package or the generated package.
+func (f *Field) isNamedType() bool {
+	expr, err := parser.ParseExpr(f.FieldType)
+	if err != nil {
+		return false
+	}
+	if t, ok := expr.(*ast.StarExpr); ok {
+		expr = t.X
+	}
+	if x, _, ok := typeArgs(expr); ok {
+		expr = x
+	}
+	c := typeChecker{field: f}
+	return c.isNamed(expr)
+}
+
+// isHeaderType reports whether the field type is string or a local type, presumably
+// of a string kind, which header values are converted to. Imported types are not allowed,
+// as their kind is unknown until the generated code is built.
+func (f *Field) isHeaderType() bool {
+	return f.FieldType == "string" || f.isLocalType(f.FieldType)
+}
+
+// typeChecker checks that a field type is built of predeclared types,
+// exported types of the field packages and local types, possibly instantiated.
+type typeChecker struct {
+	field *Field
+	// generic is set if the type instantiates generic types.
+	generic bool
+}
+
+func (c *typeChecker) check(expr ast.Expr) bool {
+	if x, args, ok := typeArgs(expr); ok {
+		c.generic = true
+		if !c.isNamed(x) {
+			return false
+		}
+		for _, arg := range args {
+			if !c.check(arg) {
+				return false
+			}
+		}
+		return true
+	}
+	switch t := expr.(type) {
+	default:
+		return false
+	case *ast.Ident:
+		return isPredeclaredType(t.Name) || c.field.isLocalType(t.Name)
+	case *ast.SelectorExpr:
+		return c.isNamed(t)
+	case *ast.InterfaceType:
+		return len(t.Methods.List) == 0
+	case *ast.ArrayType:
+		return c.check(t.Elt)
+	case *ast.MapType:
+		return c.check(t.Key) && c.check(t.Value)
+	case *ast.ChanType:
+		return c.check(t.Value)
+	case *ast.StarExpr:
+		return c.check(t.X)
+	}
+}
+
+// isNamed reports whether expr is a local type or an exported type of a field package.
+func (c *typeChecker) isNamed(expr ast.Expr) bool {
+	switch t := expr.(type) {
+	case *ast.Ident:
+		return c.field.isLocalType(t.Name)
+	case *ast.SelectorExpr:
+		x, ok := t.X.(*ast.Ident)
+		if !ok || !isExported(t.Sel.Name) {
+			return false
+		}
+		for _, pkg := range c.field.pkgs {
+			if c.field.packageName(pkg) == x.Name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeArgs returns the generic type and the type arguments of an instantiation.
+func typeArgs(expr ast.Expr) (ast.Expr, []ast.Expr, bool) {
+	if t, ok := expr.(*ast.IndexExpr); ok {
+		return t.X, []ast.Expr{t.Index}, true
+	}
+	return indexListExpr(expr)
+}
+
+// PackageName returns the name the package with the given import path is referred to
+// in the generated code, unless it is imported with another name: the last element
+// of the path without the major version suffix, e.g. foo for example.com/foo/v2
+// and yaml for gopkg.in/yaml.v3.
+func PackageName(path string) string {
+	elems := strings.Split(path, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && strings.HasPrefix(name, "v") && isNumber(name[1:]) {
+		name = elems[len(elems)-2]
+	}
+	if i := strings.LastIndex(name, ".v"); i > 0 && isNumber(name[i+2:]) {
+		name = name[:i]
+	}
+	return name
+}
+
+// localNames are the parameters and variables declared by the templates,
+// which shadow the imported packages of the same name.
+var localNames = []string{
+	"c", "ctx", "d", "done", "e", "err", "expires", "h", "isNil", "k", "l", "load",
+	"next", "ok", "once", "prev", "rv", "stop", "stopped", "stored", "v",
+}
+
+func isLocalName(name string) bool {
+	for _, l := range localNames {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ImportNames returns the names of the packages with the import paths, whose PackageName
+// collides with the name of another package or of a template variable, see localNames.
+// Standard packages and the runtime package keep their names, which the templates refer to.
+// The other packages are renamed in the order of their import paths, prefixing the name
+// with the parent path element, e.g. alog for a/log, or suffixing it with a number
+// if the prefixed name is taken too.
+func ImportNames(paths []string) map[string]string {
+	paths = append([]string(nil), paths...)
+	sort.Sort(sort.StringSlice(paths))
+	taken := map[string]bool{}
+	for _, name := range localNames {
+		taken[name] = true
+	}
+	var other []string
+	for _, path := range paths {
+		if isStandardPackage(path) || path == RuntimePackage {
+			taken[PackageName(path)] = true
+		} else {
+			other = append(other, path)
+		}
+	}
+	names := map[string]string{}
+	for _, path := range other {
+		name := PackageName(path)
+		if taken[name] {
+			name = importAlias(path, name, taken)
+			names[path] = name
+		}
+		taken[name] = true
+	}
+	return names
+}
+
+// importAlias returns a name of the package with the import path and PackageName name,
+// which is not taken.
+func importAlias(path, name string, taken map[string]bool) string {
+	elems := strings.Split(path, "/")
+	i := len(elems) - 1
+	if !strings.HasPrefix(elems[i], name) {
+		i-- // major version suffix
+	}
+	if i > 0 {
+		parent := strings.Map(func(r rune) rune {
+			if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+				return unicode.ToLower(r)
+			}
+			return -1
+		}, elems[i-1])
+		if alias := parent + name; parent != "" && isValidIdentifier(alias) && !taken[alias] {
+			return alias
+		}
+	}
+	for n := 2; ; n++ {
+		if alias := name + strconv.Itoa(n); !taken[alias] {
+			return alias
+		}
+	}
+}
+
+func usesIdent(expr ast.Expr, name string) bool {
+	found := false
+	ast.Inspect(expr, func(n ast.Node) bool {
+		if id, ok := n.(*ast.Ident); ok && id.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
+
 func isExported(name string) bool {
 	if name == "" {
 		return false
@@ -64,7 +718,7 @@ func isExported(name string) bool {
 }
 
 func isValidImportedStruct(s string) bool {
-	parts := strings.Split(s, ".")
+	parts := strings.Split(strings.TrimPrefix(s, "*"), ".")
 	if len(parts) != 2 {
 		return false
 	}
@@ -91,7 +745,7 @@ func isValidImportPath(path string) bool {
 }
 
 func isValidIdentifier(name string) bool {
-	if name == "" {
+	if name == "" || token.Lookup(name).IsKeyword() {
 		return false
 	}
 	// https://go.dev/ref/spec#Identifiers
@@ -106,29 +760,29 @@ func isValidIdentifier(name string) bool {
 	return true
 }
 
-func isBuiltInType(expr ast.Expr) bool {
-	switch t := expr.(type) {
-	default:
+// isValidHeader reports whether name is a valid HTTP header field name,
+// made of token characters, see RFC 9110.
+func isValidHeader(name string) bool {
+	if name == "" {
 		return false
-	case *ast.Ident:
-		switch t.Name {
-		case "bool", "string", "int", "int8", "int16", "int32", "int64",
-			"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
-			"byte", "rune", "float32", "float64", "complex64", "complex128":
-			return true
-		default:
+	}
+	for _, r := range name {
+		if r >= utf8.RuneSelf || !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("!#$%&'*+-.^_`|~", r) {
 			return false
 		}
-	case *ast.InterfaceType:
-		return len(t.Methods.List) == 0
-	case *ast.ArrayType:
-		return isBuiltInType(t.Elt)
-	case *ast.MapType:
-		return isBuiltInType(t.Key) && isBuiltInType(t.Value)
-	case *ast.ChanType:
-		return isBuiltInType(t.Value)
-	case *ast.StarExpr:
-		return isBuiltInType(t.X)
+	}
+	return true
+}
+
+func isPredeclaredType(name string) bool {
+	switch name {
+	case "bool", "string", "int", "int8", "int16", "int32", "int64",
+		"uint", "uint8", "uint16", "uint32", "uint64", "uintptr",
+		"byte", "rune", "float32", "float64", "complex64", "complex128",
+		"error", "any":
+		return true
+	default:
+		return false
 	}
 }
 
@@ -142,73 +796,621 @@ func isBuiltInType(expr ast.Expr) bool {
 type Package struct {
 	PackageName    string
 	ImportPackages []string
-	Version        string
+	// ImportNames are the names of the imported packages, which are imported with
+	// a name other than PackageName of their import path to avoid collisions.
+	ImportNames map[string]string
+	Version     string
+	GoVersion   GoVersion
+	// Command is the command generating the package, recorded in the header comment line by line.
+	Command []string
+}
+
+// ImportSpec returns the import spec of the package with the import path,
+// naming the package if its name differs from the last element of the path.
+func (p *Package) ImportSpec(path string) string {
+	name, ok := p.ImportNames[path]
+	if !ok {
+		name = PackageName(path)
+	}
+	if name == path[strings.LastIndex(path, "/")+1:] {
+		return strconv.Quote(path)
+	}
+	return name + " " + strconv.Quote(path)
+}
+
+// ImportGroups returns the sorted standard packages and the sorted other packages
+// of ImportPackages, the groups are separated in the import declaration.
+func (p *Package) ImportGroups() [][]string {
+	var std, other []string
+	for _, path := range p.ImportPackages {
+		if isStandardPackage(path) {
+			std = append(std, path)
+		} else {
+			other = append(other, path)
+		}
+	}
+	var groups [][]string
+	for _, group := range [][]string{std, other} {
+		if len(group) > 0 {
+			sort.Sort(sort.StringSlice(group))
+			groups = append(groups, group)
+		}
+	}
+	return groups
 }
 
 func (p *Package) Validate() error {
-	if !isValidIdentifier(p.PackageName) {
+	if !isValidIdentifier(p.PackageName) || p.PackageName == "_" {
 		return errors.New("invalid package name")
 	}
+	if err := p.GoVersion.Validate(); err != nil {
+		return err
+	}
 	for _, path := range p.ImportPackages {
 		if !isValidImportPath(path) {
 			return errors.New("invalid import path")
 		}
 	}
+	for _, line := range p.Command {
+		if strings.ContainsAny(line, "\r\n") {
+			return errors.New("recorded command can't contain line breaks")
+		}
+	}
 	return nil
 }
 
+// headerFields are the fields set by the generated FromHeader function.
+type headerFields []Field
+
+// AnyRequired reports whether any of the field headers is required.
+func (fs headerFields) AnyRequired() bool {
+	for _, f := range fs {
+		if f.HeaderRequired {
+			return true
+		}
+	}
+	return false
+}
+
+// AnySetterReturnsError reports whether any of the field setters may fail.
+func (fs headerFields) AnySetterReturnsError() bool {
+	for i := range fs {
+		if fs[i].SetterReturnsError() {
+			return true
+		}
+	}
+	return false
+}
+
+// Generate writes the source of the package with the fields, formatted with gofmt rules.
 func Generate(ctx context.Context, out io.Writer, pkg Package, fields []Field) error {
 	var (
 		pkgTemplate = template.Must(template.New("package").Parse(
 			`// Code generated by valctx {{.Version}}. DO NOT EDIT.
+{{- range .Command}}
+// {{.}}
+{{- end}}
 
 package {{.PackageName}}
 {{ if .ImportPackages }}
 import (
-    {{- range .ImportPackages }}
-    "{{.}}"
-    {{- end }}
+{{- range $i, $group := .ImportGroups }}
+{{- if $i }}
+{{ end }}
+{{- range $group }}
+    {{$.ImportSpec .}}
+{{- end }}
+{{- end }}
 )
 {{ end }}`))
-		castedFieldTemplate = template.Must(template.New("casted-field").Parse(`
+		fieldTemplate = template.Must(template.New("field").Parse(`
 type {{.KeyName}} struct{}
+{{- if .OldKeyName}}
+
+type {{.OldKeyName}} struct{}
+{{- end}}
+{{- if .SetOnce}}
+
+// Err{{.FieldName}}AlreadySet is reported by Set{{.FieldName}} if the {{.FieldName}} is already set in the context.
+var Err{{.FieldName}}AlreadySet = errors.New("{{.FieldName}} is already set in the context")
+{{- end}}
+{{- if .MarksNil}}
+
+// {{.UnexportedName "Nil"}} is stored for the nil {{.FieldName}}, so that Has{{.FieldName}} reports it as set.
+type {{.UnexportedName "Nil"}} struct{}
+{{- end}}
+{{- if .RefusesNil}}
+
+// Err{{.FieldName}}IsNil is returned by Set{{.FieldName}} for nil values.
+var Err{{.FieldName}}IsNil = errors.New("{{.FieldName}} is nil")
+{{- end}}
+{{- if .HeaderRequired}}
+
+// Err{{.FieldName}}HeaderMissing is returned by FromHeader if the {{.Header}} header is missing or empty.
+var Err{{.FieldName}}HeaderMissing = errors.New("{{.Header}} header is missing")
+{{- end}}
+{{- if .TTL}}
+
+// {{.UnexportedName "Entry"}} is the {{.FieldName}} stored with its expiry time.
+type {{.UnexportedName "Entry"}} struct {
+    v       {{.FieldType}}
+    expires time.Time
+}
+
+func (e {{.UnexportedName "Entry"}}) expired() bool {
+    return !e.expires.IsZero() && !now{{.FieldName}}().Before(e.expires)
+}
+
+// now{{.FieldName}} returns the current time to check the {{.FieldName}} expiry.
+// Replace it in tests to control the time.
+var now{{.FieldName}} = time.Now
+{{- end}}
 
 // Get {{.FieldName}} retrieves the {{.FieldName}} from the context.
-func Get{{.FieldName}}(ctx context.Context) ({{.FieldType}}, bool) {
+{{- if .OldFieldName}}
+// It falls back to the value stored with the former {{.OldFieldName}} key.
+{{- end}}
+{{- if .CopiesOnGet}}
+// It returns a copy of the stored value.
+{{- end}}
+{{- if .TTL}}
+// The expired {{.FieldName}} is reported as absent.
+{{- end}}
+{{- if .Nil}}
+// The nil {{.FieldName}} is reported as absent.
+{{- end}}
+func Get{{.FieldName}}(ctx context.Context) {{.GetterResults}} {
+{{- if .IsAny}}
+{{- if .TTL}}
+    e, ok := ctx.Value({{.KeyName}}{}).({{.UnexportedName "Entry"}})
+    if ok && e.expired() {
+        e = {{.UnexportedName "Entry"}}{}
+    }
+    v := e.v
+{{- else}}
+    v := ctx.Value({{.KeyName}}{})
+{{- if .MarksNil}}
+    if _, isNil := v.({{.UnexportedName "Nil"}}); isNil {
+        v = nil
+    }
+{{- end}}
+{{- end}}
+{{- if .OldKeyName}}
+    if v == nil {
+        v = ctx.Value({{.OldKeyName}}{})
+    }
+{{- end}}
+{{- if .Nil}}
+    if {{.NilCheck}} {
+        v = nil
+    }
+{{- end}}
+    return v
+{{- else}}
+{{- if .TTL}}
+    e, ok := ctx.Value({{.KeyName}}{}).({{.UnexportedName "Entry"}})
+    if ok && e.expired() {
+        e, ok = {{.UnexportedName "Entry"}}{}, false
+    }
+    v := e.v
+{{- else}}
     v, ok := ctx.Value({{.KeyName}}{}).({{.FieldType}})
+{{- end}}
+{{- if .OldKeyName}}
+    if !ok {
+        v, ok = ctx.Value({{.OldKeyName}}{}).({{.FieldType}})
+    }
+{{- end}}
+{{- if .Nil}}
+    if ok && {{.NilCheck}} {
+        ok = false
+    }
+{{- end}}
+{{- if .CopiesOnGet}}
+    return clone{{.FieldName}}(v), ok
+{{- else}}
     return v, ok
+{{- end}}
+{{- end}}
 }
+{{- if .SetOnce}}
+
+// Has{{.FieldName}} reports whether the {{.FieldName}} is set in the context.
+func Has{{.FieldName}}(ctx context.Context) bool {
+{{- if .MarksNil}}
+    if ctx.Value({{.KeyName}}{}) != nil {
+        return true
+    }
+{{- if .OldKeyName}}
+    return ctx.Value({{.OldKeyName}}{}) != nil
+{{- else}}
+    return false
+{{- end}}
+{{- else if .CopiesOnGet}}
+{{- if .TTL}}
+    e, ok := ctx.Value({{.KeyName}}{}).({{.UnexportedName "Entry"}})
+    ok = ok && !e.expired()
+{{- if .Nil}}
+    v := e.v
+{{- end}}
+{{- else}}
+    {{if .Nil}}v{{else}}_{{end}}, ok := ctx.Value({{.KeyName}}{}).({{.FieldType}})
+{{- end}}
+{{- if .OldKeyName}}
+    if !ok {
+        {{if .Nil}}v{{else}}_{{end}}, ok = ctx.Value({{.OldKeyName}}{}).({{.FieldType}})
+    }
+{{- end}}
+{{- if .Nil}}
+    return ok && !({{.NilCheck}})
+{{- else}}
+    return ok
+{{- end}}
+{{- else if and .IsAny .TTL}}
+    e, ok := ctx.Value({{.KeyName}}{}).({{.UnexportedName "Entry"}})
+    ok = ok && !e.expired()
+{{- if .OldKeyName}}
+    if !ok {
+        e.v = ctx.Value({{.OldKeyName}}{})
+        ok = e.v != nil
+    }
+{{- end}}
+{{- if .Nil}}
+    v := e.v
+    return ok && !({{.NilCheck}})
+{{- else}}
+    return ok
+{{- end}}
+{{- else}}
+    _, ok := Get{{.FieldName}}(ctx)
+    return ok
+{{- end}}
+}
+{{- end}}
 
 // Set{{.FieldName}} sets the {{.FieldName}} in the context.
-func Set{{.FieldName}}(ctx context.Context, v {{.FieldType}}) context.Context {
-    return context.WithValue(ctx, {{.KeyName}}{}, v)
+{{- if .Closer}}
+// The {{.FieldName}} is closed when the context is done, unless the returned stop function is called before.
+// stop reports whether it prevented closing; call it if the context is never done to release resources.
+// The nil {{.FieldName}} is not closed.
+{{- end}}
+{{- if .CopiesOnSet}}
+// The context keeps a copy of v.
+{{- end}}
+{{- if .DropsNil}}
+// The nil {{.FieldName}} is ignored.
+{{- else if .RefusesNil}}
+// It returns Err{{.FieldName}}IsNil for the nil {{.FieldName}}.
+{{- end}}
+{{- if .Validator}}
+// It returns the error of {{.Validator}} for invalid values.
+{{- end}}
+{{- if .SetOncePanics}}
+// It panics with Err{{.FieldName}}AlreadySet if the {{.FieldName}} is already set.
+{{- else if .SetOnce}}
+// It returns Err{{.FieldName}}AlreadySet if the {{.FieldName}} is already set.
+{{- end}}
+func Set{{.FieldName}}(ctx context.Context, v {{.FieldType}}) {{.SetterResults}} {
+{{- if .TTL}}
+    return set{{.FieldName}}(ctx, v, time.Time{})
+}
+
+// Set{{.FieldName}}WithTTL sets the {{.FieldName}} in the context like Set{{.FieldName}},
+// but the {{.FieldName}} expires after d.
+func Set{{.FieldName}}WithTTL(ctx context.Context, v {{.FieldType}}, d time.Duration) {{.SetterResults}} {
+    return set{{.FieldName}}(ctx, v, now{{.FieldName}}().Add(d))
+}
+
+// set{{.FieldName}} sets the {{.FieldName}} expiring at the given time, zero time means no expiry.
+func set{{.FieldName}}(ctx context.Context, v {{.FieldType}}, expires time.Time) {{.SetterResults}} {
+{{- end}}
+{{- if .DropsNil}}
+    if {{.NilCheck}} {
+{{- if .SetterReturnsError}}
+        return ctx, nil
+{{- else}}
+        return ctx
+{{- end}}
+    }
+{{- else if .RefusesNil}}
+    if {{.NilCheck}} {
+        return ctx, Err{{.FieldName}}IsNil
+    }
+{{- end}}
+{{- if .Validator}}
+    if err := {{.Validator}}(v); err != nil {
+        return ctx, err
+    }
+{{- end}}
+{{- if .SetOnce}}
+    if Has{{.FieldName}}(ctx) {
+{{- if .SetOncePanics}}
+        panic(Err{{.FieldName}}AlreadySet)
+{{- else}}
+        return ctx, Err{{.FieldName}}AlreadySet
+{{- end}}
+    }
+{{- end}}
+{{- if .CopiesOnSet}}
+    v = clone{{.FieldName}}(v)
+{{- end}}
+{{- if .MarksNil}}
+    var stored interface{} = v
+    if stored == nil {
+        stored = {{.UnexportedName "Nil"}}{}
+    }
+{{- end}}
+{{- if .Closer}}
+    ctx = context.WithValue(ctx, {{.KeyName}}{}, {{.StoredValue}})
+    if {{.NilCheck}} {
+        return ctx, func() bool { return false }
+    }
+{{- if .UsesAfterFunc}}
+    stop := context.AfterFunc(ctx, func() {
+        _ = v.Close()
+    })
+    return ctx, stop
+{{- else}}
+    var once sync.Once
+    stopped := make(chan struct{})
+    if done := ctx.Done(); done != nil {
+        go func() {
+            select {
+            case <-done:
+                once.Do(func() {
+                    _ = v.Close()
+                })
+            case <-stopped:
+            }
+        }()
+    }
+    return ctx, func() bool {
+        ok := false
+        once.Do(func() {
+            ok = true
+            close(stopped)
+        })
+        return ok
+    }
+{{- end}}
+{{- else if .SetterReturnsError}}
+    return context.WithValue(ctx, {{.KeyName}}{}, {{.StoredValue}}), nil
+{{- else}}
+    return context.WithValue(ctx, {{.KeyName}}{}, {{.StoredValue}})
+{{- end}}
+}
+{{- if .OldFieldName}}
+
+// Get{{.OldFieldName}} retrieves the {{.FieldName}} from the context.
+//
+// Deprecated: {{.OldFieldName}} is renamed, use Get{{.FieldName}} instead.
+func Get{{.OldFieldName}}(ctx context.Context) {{.GetterResults}} {
+    return Get{{.FieldName}}(ctx)
+}
+
+// Set{{.OldFieldName}} sets the {{.FieldName}} in the context.
+//
+// Deprecated: {{.OldFieldName}} is renamed, use Set{{.FieldName}} instead.
+func Set{{.OldFieldName}}(ctx context.Context, v {{.FieldType}}) {{.SetterResults}} {
+    return Set{{.FieldName}}(ctx, v)
+}
+{{- end}}
+{{- if .UsesIsNil}}
+
+// isNil{{.FieldName}} reports whether v is nil, including nil values of non-interface types.
+func isNil{{.FieldName}}(v {{.FieldType}}) bool {
+    rv := reflect.ValueOf(v)
+    switch rv.Kind() {
+    case reflect.Invalid:
+        return true
+    case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+        return rv.IsNil()
+    }
+    return false
 }
+{{- end}}
+{{- if .Copy}}
+
+// clone{{.FieldName}} returns a shallow copy of v.
+func clone{{.FieldName}}(v {{.FieldType}}) {{.FieldType}} {
+{{- if .UsesStdClone}}
+    return {{.CopyKind}}s.Clone(v)
+{{- else}}
+    if v == nil {
+        return nil
+    }
+{{- if eq .CopyKind "slice"}}
+    c := make({{.FieldType}}, len(v))
+    copy(c, v)
+    return c
+{{- else if eq .CopyKind "map"}}
+    c := make({{.FieldType}}, len(v))
+    for k, e := range v {
+        c[k] = e
+    }
+    return c
+{{- else}}
+    c := *v
+    return &c
+{{- end}}
+{{- end}}
+}
+{{- end}}
 `))
-		anyFieldTemplate = template.Must(template.New("any-field").Parse(`
+		lazyFieldTemplate = template.Must(template.New("lazy-field").Parse(`
 type {{.KeyName}} struct{}
 
+// {{.UnexportedName "Loader"}} loads the {{.FieldName}} at most once.
+type {{.UnexportedName "Loader"}} struct {
+    once sync.Once
+    load func() ({{.FieldType}}, error)
+    v    {{.FieldType}}
+    err  error
+}
+
 // Get {{.FieldName}} retrieves the {{.FieldName}} from the context.
-func Get{{.FieldName}}(ctx context.Context) interface{} {
-    v := ctx.Value({{.KeyName}}{})
+// The loader is called on the first call only, its result and error are cached.
+// ok is false if the loader is not set.
+func Get{{.FieldName}}(ctx context.Context) (v {{.FieldType}}, ok bool, err error) {
+    l, ok := ctx.Value({{.KeyName}}{}).(*{{.UnexportedName "Loader"}})
+    if !ok {
+        return v, false, nil
+    }
+    l.once.Do(func() {
+        l.v, l.err = l.load()
+    })
+    return l.v, true, l.err
+}
+
+// Set{{.FieldName}}Loader sets the loader of the {{.FieldName}} in the context.
+// The loader is shared by all contexts derived from the returned one.
+// It panics if load is nil.
+func Set{{.FieldName}}Loader(ctx context.Context, load func() ({{.FieldType}}, error)) context.Context {
+    if load == nil {
+        panic("Set{{.FieldName}}Loader: nil loader")
+    }
+    return context.WithValue(ctx, {{.KeyName}}{}, &{{.UnexportedName "Loader"}}{load: load})
+}
+`))
+		mutableFieldTemplate = template.Must(template.New("mutable-field").Parse(`
+type {{.KeyName}} struct{}
+
+// {{.UnexportedName "Holder"}} holds the {{.FieldName}} shared by contexts derived from the one returned by Init{{.FieldName}}.
+type {{.UnexportedName "Holder"}} struct {
+    mu sync.RWMutex
+    v  {{.FieldType}}
+    ok bool
+}
+
+// Init{{.FieldName}} installs the holder of the {{.FieldName}} in the context.
+// If the holder is already installed, the context is returned as is.
+func Init{{.FieldName}}(ctx context.Context) context.Context {
+    if _, ok := ctx.Value({{.KeyName}}{}).(*{{.UnexportedName "Holder"}}); ok {
+        return ctx
+    }
+    return context.WithValue(ctx, {{.KeyName}}{}, &{{.UnexportedName "Holder"}}{})
+}
+
+// Store{{.FieldName}} stores the {{.FieldName}} in the holder installed by Init{{.FieldName}}.
+// It reports false if the holder is not installed.
+func Store{{.FieldName}}(ctx context.Context, v {{.FieldType}}) bool {
+    h, ok := ctx.Value({{.KeyName}}{}).(*{{.UnexportedName "Holder"}})
+    if !ok {
+        return false
+    }
+    h.mu.Lock()
+    h.v, h.ok = v, true
+    h.mu.Unlock()
+    return true
+}
+
+// Load{{.FieldName}} retrieves the {{.FieldName}} from the holder installed by Init{{.FieldName}}.
+// ok is false if the holder is not installed or the {{.FieldName}} is not stored yet.
+func Load{{.FieldName}}(ctx context.Context) (v {{.FieldType}}, ok bool) {
+    h, ok := ctx.Value({{.KeyName}}{}).(*{{.UnexportedName "Holder"}})
+    if !ok {
+        return v, false
+    }
+    h.mu.RLock()
+    defer h.mu.RUnlock()
+    return h.v, h.ok
+}
+`))
+		appendFieldTemplate = template.Must(template.New("append-field").Parse(`
+type {{.KeyName}} struct{}
+
+// Get {{.FieldName}} retrieves all the {{.FieldName}} appended to the context.
+// The returned slice must not be modified.
+func Get{{.FieldName}}(ctx context.Context) []{{.FieldType}} {
+    v, _ := ctx.Value({{.KeyName}}{}).([]{{.FieldType}})
     return v
 }
 
+// Append{{.FieldName}} appends v to the {{.FieldName}} in the context.
+// The {{.FieldName}} of the parent context are not modified.
+func Append{{.FieldName}}(ctx context.Context, v ...{{.FieldType}}) context.Context {
+{{- if .UsesStdConcat}}
+    return context.WithValue(ctx, {{.KeyName}}{}, slices.Concat(Get{{.FieldName}}(ctx), v))
+{{- else}}
+    prev := Get{{.FieldName}}(ctx)
+    next := make([]{{.FieldType}}, 0, len(prev)+len(v))
+    next = append(next, prev...)
+    next = append(next, v...)
+    return context.WithValue(ctx, {{.KeyName}}{}, next)
+{{- end}}
+}
+`))
+		keyFieldTemplate = template.Must(template.New("key-field").Parse(`
+// {{.FieldName}}Key is the key of the {{.FieldName}}, use it to access the {{.FieldName}} with the valctx package.
+var {{.FieldName}}Key = valctx.NewKey[{{.FieldType}}]("{{.FieldName}}")
+
+// Get {{.FieldName}} retrieves the {{.FieldName}} from the context.
+func Get{{.FieldName}}(ctx context.Context) {{.GetterResults}} {
+{{- if .IsAny}}
+    v, _ := {{.FieldName}}Key.Get(ctx)
+    return v
+{{- else}}
+    return {{.FieldName}}Key.Get(ctx)
+{{- end}}
+}
+
 // Set{{.FieldName}} sets the {{.FieldName}} in the context.
-func Set{{.FieldName}}(ctx context.Context, v interface{}) context.Context {
-    return context.WithValue(ctx, {{.KeyName}}{}, v)
+func Set{{.FieldName}}(ctx context.Context, v {{.FieldType}}) context.Context {
+    return {{.FieldName}}Key.Set(ctx, v)
+}
+`))
+		headerTemplate = template.Must(template.New("header").Parse(`
+// FromHeader sets the fields from the HTTP header h in the context:
+{{- range .}}
+//   - {{.FieldName}} from {{.Header}}{{if .HeaderRequired}}, required{{end}}
+{{- end}}
+//
+// The fields with a missing or empty header are not set.
+{{- if .AnyRequired}}
+// A missing required header is reported with the Err*HeaderMissing error of its field.
+{{- end}}
+{{- if .AnySetterReturnsError}}
+// The first error of a setter is returned.
+{{- end}}
+{{- if or .AnyRequired .AnySetterReturnsError}}
+// On error, the context is returned unchanged.
+{{- end}}
+func FromHeader(ctx context.Context, h http.Header) (context.Context, error) {
+    next := ctx
+{{- range .}}
+    if v := h.Get({{printf "%q" .Header}}); v != "" {
+{{- if .SetterReturnsError}}
+        var err error
+        if next, err = Set{{.FieldName}}(next, {{.HeaderValue}}); err != nil {
+            return ctx, err
+        }
+{{- else}}
+        next = Set{{.FieldName}}(next, {{.HeaderValue}})
+{{- end}}
+    }
+{{- if .HeaderRequired}} else {
+        return ctx, Err{{.FieldName}}HeaderMissing
+    }
+{{- end}}
+{{- end}}
+    return next, nil
 }
 `))
 	)
-	err := pkgTemplate.Execute(out, pkg)
+	fieldTemplates := map[Kind]*template.Template{
+		KindValue:   fieldTemplate,
+		KindLazy:    lazyFieldTemplate,
+		KindMutable: mutableFieldTemplate,
+		KindAppend:  appendFieldTemplate,
+		KindKey:     keyFieldTemplate,
+	}
+	var buf bytes.Buffer
+	err := pkgTemplate.Execute(&buf, &pkg)
 	if err != nil {
 		return fmt.Errorf("bootstrap package: %v", err)
 	}
 	for _, field := range fields {
-		tmpl := castedFieldTemplate
-		if field.FieldType == "interface{}" {
-			tmpl = anyFieldTemplate
-		}
-		err = tmpl.Execute(out, &field)
+		err = fieldTemplates[field.Kind].Execute(&buf, &field)
 		if err != nil {
 			return fmt.Errorf("bootstrap field %q: %v", field.FieldName, err)
 		}
@@ -217,5 +1419,21 @@ func Set{{.FieldName}}(ctx context.Context, v interface{}) context.Context {
 			return ctx.Err()
 		}
 	}
-	return nil
+	var header headerFields
+	for _, field := range fields {
+		if field.Header != "" {
+			header = append(header, field)
+		}
+	}
+	if len(header) > 0 {
+		if err = headerTemplate.Execute(&buf, header); err != nil {
+			return fmt.Errorf("bootstrap FromHeader: %v", err)
+		}
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("generated code is invalid: %v", err)
+	}
+	_, err = out.Write(src)
+	return err
 }
@@ -0,0 +1,15 @@
+//go:build go1.18
+// +build go1.18
+
+package gen
+
+import "go/ast"
+
+// indexListExpr returns the generic type and the type arguments
+// of an instantiation with several type arguments.
+func indexListExpr(expr ast.Expr) (ast.Expr, []ast.Expr, bool) {
+	if t, ok := expr.(*ast.IndexListExpr); ok {
+		return t.X, t.Indices, true
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,13 @@
+//go:build !go1.18
+// +build !go1.18
+
+package gen
+
+import "go/ast"
+
+// indexListExpr returns the generic type and the type arguments
+// of an instantiation with several type arguments.
+// The go parser before go 1.18 doesn't support them.
+func indexListExpr(expr ast.Expr) (ast.Expr, []ast.Expr, bool) {
+	return nil, nil, false
+}
@@ -0,0 +1,95 @@
+package gen
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GoVersion is the Go version targeted by the generated code.
+// The zero value targets the oldest supported version, Go 1.7.
+type GoVersion struct {
+	Major int
+	Minor int
+}
+
+// ParseGoVersion parses versions in the go.mod and toolchain formats: "1.21", "1.21.3",
+// "1.21rc1", "1.21beta1", optionally prefixed with "go" like "go1.21.3".
+// Patch versions and pre-releases are ignored, as language features don't depend on them.
+func ParseGoVersion(s string) (GoVersion, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("invalid go version %q: %s, want 1.N, 1.N.P, 1.NrcR or 1.NbetaR", s, reason)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, "go"), ".", 3)
+	if len(parts) < 2 {
+		return GoVersion{}, invalid("no minor version")
+	}
+	minor := parts[1]
+	if len(parts) == 3 {
+		if !isNumber(parts[2]) {
+			return GoVersion{}, invalid(fmt.Sprintf("bad patch version %q", parts[2]))
+		}
+	} else {
+		for _, pre := range []string{"rc", "beta"} {
+			if i := strings.Index(minor, pre); i >= 0 {
+				if !isNumber(minor[i+len(pre):]) {
+					return GoVersion{}, invalid(fmt.Sprintf("bad pre-release %q", minor[i:]))
+				}
+				minor = minor[:i]
+				break
+			}
+		}
+	}
+	if !isNumber(parts[0]) {
+		return GoVersion{}, invalid(fmt.Sprintf("bad major version %q", parts[0]))
+	}
+	if !isNumber(minor) {
+		return GoVersion{}, invalid(fmt.Sprintf("bad minor version %q", minor))
+	}
+	v := GoVersion{}
+	v.Major, _ = strconv.Atoi(parts[0])
+	v.Minor, _ = strconv.Atoi(minor)
+	if err := v.Validate(); err != nil {
+		return GoVersion{}, err
+	}
+	return v, nil
+}
+
+// isNumber reports whether s is a non-empty decimal number without a sign.
+func isNumber(s string) bool {
+	if s == "" || len(s) > 9 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (v GoVersion) String() string {
+	if v == (GoVersion{}) {
+		return "1.7"
+	}
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+func (v GoVersion) Validate() error {
+	if v == (GoVersion{}) {
+		return nil
+	}
+	if v.Major != 1 || v.Minor < 7 {
+		return errors.New("go version must be 1.7 or later")
+	}
+	return nil
+}
+
+// AtLeast reports whether the version is the given one or later.
+func (v GoVersion) AtLeast(major, minor int) bool {
+	if v == (GoVersion{}) {
+		v = GoVersion{Major: 1, Minor: 7}
+	}
+	return v.Major > major || v.Major == major && v.Minor >= minor
+}
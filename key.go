@@ -0,0 +1,90 @@
+//go:build go1.18
+// +build go1.18
+
+package valctx
+
+import (
+	"context"
+	"fmt"
+)
+
+// key is the context key of a Key. Keys are compared by pointer,
+// so keys with the same name and type are still distinct.
+type key struct {
+	name string
+}
+
+// String makes contexts print the key name.
+func (k *key) String() string {
+	return k.name
+}
+
+// Key is a typed context key. Use NewKey to create keys: the zero Key is never set,
+// and Set panics for it, so that zero keys don't share values.
+type Key[T any] struct {
+	k *key
+}
+
+// NewKey returns a new key of values of type T. The name is used in messages only.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{k: &key{name: name}}
+}
+
+// zeroKeyName is the name of the zero Key.
+const zeroKeyName = "<zero Key>"
+
+// Name returns the name of the key.
+func (k Key[T]) Name() string {
+	if k.k == nil {
+		return zeroKeyName
+	}
+	return k.k.name
+}
+
+func (k Key[T]) String() string {
+	return "valctx.Key(" + k.Name() + ")"
+}
+
+// Get retrieves the value of the key from the context.
+// ok is false if the value is not set. For interface types, nil values are reported as not set.
+func (k Key[T]) Get(ctx context.Context) (v T, ok bool) {
+	if k.k == nil {
+		return v, false
+	}
+	v, ok = ctx.Value(k.k).(T)
+	return v, ok
+}
+
+// Set returns a copy of ctx with the value of the key set to v.
+// It panics for the zero Key.
+func (k Key[T]) Set(ctx context.Context, v T) context.Context {
+	if k.k == nil {
+		panic("valctx: Set of the zero Key, create keys with NewKey")
+	}
+	return context.WithValue(ctx, k.k, v)
+}
+
+// Must retrieves the value of the key from the context.
+// It panics if the value is not set.
+func (k Key[T]) Must(ctx context.Context) T {
+	v, ok := k.Get(ctx)
+	if !ok {
+		panic(fmt.Sprintf("valctx: %s is not set in the context", k.Name()))
+	}
+	return v
+}
+
+// OrDefault retrieves the value of the key from the context,
+// or returns def if the value is not set.
+func (k Key[T]) OrDefault(ctx context.Context, def T) T {
+	if v, ok := k.Get(ctx); ok {
+		return v
+	}
+	return def
+}
+
+// Has reports whether the value of the key is set in the context.
+func (k Key[T]) Has(ctx context.Context) bool {
+	_, ok := k.Get(ctx)
+	return ok
+}
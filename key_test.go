@@ -0,0 +1,100 @@
+//go:build go1.18
+// +build go1.18
+
+package valctx
+
+import (
+	"context"
+	"testing"
+)
+
+func TestKey(t *testing.T) {
+	userID := NewKey[string]("UserID")
+	other := NewKey[string]("UserID")
+	ctx := context.Background()
+
+	if userID.Has(ctx) {
+		t.Error("Has() = true for empty context")
+	}
+	if v := userID.OrDefault(ctx, "default"); v != "default" {
+		t.Errorf("OrDefault() = %q; want %q", v, "default")
+	}
+
+	ctx = userID.Set(ctx, "42")
+	if v, ok := userID.Get(ctx); !ok || v != "42" {
+		t.Errorf("Get() = %q, %v; want %q, true", v, ok, "42")
+	}
+	if v := userID.Must(ctx); v != "42" {
+		t.Errorf("Must() = %q; want %q", v, "42")
+	}
+	if v := userID.OrDefault(ctx, "default"); v != "42" {
+		t.Errorf("OrDefault() = %q; want %q", v, "42")
+	}
+	if other.Has(ctx) {
+		t.Error("Has() = true for another key with the same name")
+	}
+}
+
+func TestKeysWithSameName(t *testing.T) {
+	first := NewKey[string]("UserID")
+	second := NewKey[string]("UserID")
+	ctx := first.Set(context.Background(), "first")
+	ctx = second.Set(ctx, "second")
+	if v, _ := first.Get(ctx); v != "first" {
+		t.Errorf("first.Get() = %q; want %q", v, "first")
+	}
+	if v, _ := second.Get(ctx); v != "second" {
+		t.Errorf("second.Get() = %q; want %q", v, "second")
+	}
+	if v, ok := NewKey[string]("UserID").Get(ctx); ok {
+		t.Errorf("Get() = %q, true for a new key with the same name", v)
+	}
+}
+
+func TestKeyMustPanics(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Must() didn't panic for unset value")
+		}
+	}()
+	NewKey[int]("Count").Must(context.Background())
+}
+
+func TestKeyInterface(t *testing.T) {
+	key := NewKey[error]("Err")
+	ctx := key.Set(context.Background(), nil)
+	if v, ok := key.Get(ctx); ok || v != nil {
+		t.Errorf("Get() = %v, %v; want nil, false for nil interface value", v, ok)
+	}
+}
+
+func TestZeroKey(t *testing.T) {
+	var key Key[string]
+	if name := key.Name(); name != "<zero Key>" {
+		t.Errorf("Name() = %q; want %q", name, "<zero Key>")
+	}
+	if s := key.String(); s != "valctx.Key(<zero Key>)" {
+		t.Errorf("String() = %q; want %q", s, "valctx.Key(<zero Key>)")
+	}
+	if v, ok := key.Get(context.Background()); ok || v != "" {
+		t.Errorf("Get() = %q, %v; want zero value, false", v, ok)
+	}
+	if v := key.OrDefault(context.Background(), "default"); v != "default" {
+		t.Errorf("OrDefault() = %q; want %q", v, "default")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != "valctx: <zero Key> is not set in the context" {
+				t.Errorf("Must() panics with %v", r)
+			}
+		}()
+		key.Must(context.Background())
+	}()
+	defer func() {
+		if r := recover(); r != "valctx: Set of the zero Key, create keys with NewKey" {
+			t.Errorf("Set() panics with %v", r)
+		}
+	}()
+	key.Set(context.Background(), "value")
+	t.Error("Set() didn't panic for the zero Key")
+}
@@ -0,0 +1,176 @@
+package valctxgen
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hightech-ninja/valctx/internal/gen"
+)
+
+// checkCollisions reports the declarations of the generated file colliding with
+// the declarations of other files of the output package, generated by valctx or not.
+// Files excluded from the build by file names or build constraints are ignored.
+func (s *Spec) checkCollisions(ctx context.Context, pkg gen.Package, fields []gen.Field) error {
+	dir := filepath.Dir(s.Output)
+	declared, err := packageDecls(dir, s.Package, s.Output)
+	if err != nil {
+		return Errors{&SpecError{Setting: "Output", Err: err}}
+	}
+	if len(declared) == 0 {
+		return nil
+	}
+	var errs Errors
+	specFields := s.fields()
+	for i, field := range fields {
+		names, err := generatedDecls(ctx, pkg, []gen.Field{field})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if pos, ok := declared[name]; ok {
+				errs = append(errs, &CollisionError{Index: i, Name: field.FieldName, Pos: specFields[i].Pos, Decl: name, DeclPos: pos})
+			}
+		}
+	}
+	return errs.orNil()
+}
+
+// checkFieldClashes reports the declarations generated for several fields, e.g. the loader
+// setter SetUserLoader of a lazy User field and the setter of a UserLoader field.
+// The fields are the compiled specFields.
+func checkFieldClashes(ctx context.Context, pkg gen.Package, fields []gen.Field, specFields []Field) error {
+	names, err := generatedDecls(ctx, pkg, fields)
+	if err != nil {
+		return err
+	}
+	count := map[string]int{}
+	clash := false
+	for _, name := range names {
+		count[name]++
+		clash = clash || count[name] > 1
+	}
+	if !clash {
+		return nil
+	}
+	var errs Errors
+	owners := map[string]string{} // clashing declaration to the first field generating it
+	for i, field := range fields {
+		names, err := generatedDecls(ctx, pkg, []gen.Field{field})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if count[name] < 2 {
+				continue
+			}
+			if owner, ok := owners[name]; ok {
+				errs = append(errs, &FieldClashError{Index: i, Name: field.FieldName, Pos: specFields[i].Pos, Decl: name, Other: owner})
+				continue
+			}
+			owners[name] = field.FieldName
+		}
+	}
+	return errs.orNil()
+}
+
+// generatedDecls returns the names of the package-level declarations generated for the fields,
+// in source order.
+func generatedDecls(ctx context.Context, pkg gen.Package, fields []gen.Field) ([]string, error) {
+	var buf bytes.Buffer
+	if err := gen.Generate(ctx, &buf, pkg, fields); err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), "", buf.Bytes(), 0)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, decl := range file.Decls {
+		for _, id := range declIdents(decl) {
+			names = append(names, id.Name)
+		}
+	}
+	return names, nil
+}
+
+// packageDecls returns the package-level declarations of the files of the package in dir,
+// except the output file, with their positions.
+func packageDecls(dir, pkgName, output string) (map[string]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	declared := map[string]string{}
+	fset := token.NewFileSet()
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || filepath.Clean(path) == filepath.Clean(output) {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			return nil, fmt.Errorf("parse package: %v", err)
+		}
+		if file.Name.Name != pkgName {
+			continue
+		}
+		for name, pos := range fileDecls(fset, file) {
+			declared[name] = pos
+		}
+	}
+	return declared, nil
+}
+
+// fileDecls returns the package-level declarations of the file with their positions.
+func fileDecls(fset *token.FileSet, file *ast.File) map[string]string {
+	decls := map[string]string{}
+	for _, decl := range file.Decls {
+		for _, id := range declIdents(decl) {
+			decls[id.Name] = fset.Position(id.Pos()).String()
+		}
+	}
+	return decls
+}
+
+// declIdents returns the identifiers declared in the package scope by decl,
+// methods and blank identifiers are skipped.
+func declIdents(decl ast.Decl) []*ast.Ident {
+	var ids []*ast.Ident
+	switch d := decl.(type) {
+	case *ast.FuncDecl:
+		if d.Recv == nil && d.Name.Name != "init" {
+			ids = append(ids, d.Name)
+		}
+	case *ast.GenDecl:
+		for _, spec := range d.Specs {
+			switch s := spec.(type) {
+			case *ast.TypeSpec:
+				ids = append(ids, s.Name)
+			case *ast.ValueSpec:
+				ids = append(ids, s.Names...)
+			}
+		}
+	}
+	named := ids[:0]
+	for _, id := range ids {
+		if id.Name != "_" {
+			named = append(named, id)
+		}
+	}
+	return named
+}
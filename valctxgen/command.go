@@ -0,0 +1,189 @@
+package valctxgen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotGenerated is returned by ReadArgs and ReadVersion for files not generated by valctx.
+	ErrNotGenerated = errors.New("file is not generated by valctx")
+	// ErrNoCommand is returned by ReadArgs for files generated by valctx versions
+	// not recording the command in the header.
+	ErrNoCommand = errors.New("file has no recorded valctx command")
+)
+
+const (
+	generatedPrefix = "// Code generated by valctx "
+	generatedSuffix = ". DO NOT EDIT."
+	commandPrefix   = "// valctx "
+)
+
+// Args returns the valctx command line flags generating the spec, except -output:
+// the generated file header records them to regenerate the file.
+func (s Spec) Args() []string {
+	args := []string{"-package", s.Package}
+	if s.GoVersion != "" {
+		args = append(args, "-go", s.GoVersion)
+	}
+	if s.NilIsAbsent != "" {
+		args = append(args, "-nil-is-absent", s.NilIsAbsent)
+	}
+	if s.RuntimeKeys {
+		args = append(args, "-runtime-keys")
+	}
+	if s.VerifyLocalTypes {
+		args = append(args, "-verify-local-types")
+	}
+	if s.ScanFields {
+		args = append(args, "-scan-fields")
+	}
+	for _, f := range s.Fields {
+		args = append(args, "-field", f.String())
+	}
+	for _, raw := range s.RawFields {
+		if f, err := ParseField(raw); err == nil {
+			raw = f.String()
+		}
+		args = append(args, "-field", raw)
+	}
+	return args
+}
+
+// commandLines formats the valctx command with the spec flags for the header comment,
+// one field per line, the lines are continued with a backslash.
+func (s Spec) commandLines() []string {
+	var (
+		lines []string
+		line  = "valctx"
+	)
+	args := s.Args()
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-field" {
+			lines = append(lines, line+" \\")
+			line = "  -field " + quoteArg(args[i+1])
+			i++
+			continue
+		}
+		line += " " + quoteArg(args[i])
+	}
+	return append(lines, line)
+}
+
+// ReadArgs returns the command line flags recorded in the header of a file generated by valctx,
+// see Spec.Args.
+func ReadArgs(src []byte) ([]string, error) {
+	var (
+		generated bool
+		command   []string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		switch {
+		case strings.HasPrefix(line, generatedPrefix):
+			generated = true
+		case generated && command == nil && strings.HasPrefix(line, commandPrefix):
+			command = append(command, strings.TrimPrefix(line, commandPrefix))
+		case command != nil && strings.HasSuffix(command[len(command)-1], "\\"):
+			last := command[len(command)-1]
+			command[len(command)-1] = strings.TrimSuffix(last, "\\")
+			command = append(command, strings.TrimPrefix(line, "//"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	switch {
+	case !generated:
+		return nil, ErrNotGenerated
+	case command == nil:
+		return nil, ErrNoCommand
+	}
+	args, err := splitArgs(strings.Join(command, " "))
+	if err != nil {
+		return nil, fmt.Errorf("recorded valctx command: %v", err)
+	}
+	if len(args) == 0 || !strings.HasPrefix(args[0], "-") {
+		return nil, errors.New("recorded valctx command has no flags")
+	}
+	return args, nil
+}
+
+// ReadVersion returns the valctx version recorded in the header of a file generated by valctx.
+func ReadVersion(src []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(src))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if !strings.HasPrefix(line, "//") {
+			break
+		}
+		if strings.HasPrefix(line, generatedPrefix) && strings.HasSuffix(line, generatedSuffix) {
+			return strings.TrimSuffix(strings.TrimPrefix(line, generatedPrefix), generatedSuffix), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", ErrNotGenerated
+}
+
+// quoteArg quotes arg with single quotes if it contains characters special for shells,
+// so that the recorded command may be copied to a terminal.
+func quoteArg(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_./:,=@%+-") == "" {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// splitArgs splits a command line quoted by quoteArg into arguments.
+// It is used for recorded commands and directives.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		arg     bytes.Buffer
+		inArg   bool
+		quoted  bool
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			arg.WriteRune(r)
+			escaped = false
+		case quoted:
+			if r == '\'' {
+				quoted = false
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'':
+			quoted, inArg = true, true
+		case r == '\\':
+			escaped, inArg = true, true
+		case r == ' ' || r == '\t':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quoted || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
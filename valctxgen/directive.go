@@ -0,0 +1,193 @@
+package valctxgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	directivePrefix   = "//valctx:"
+	generateDirective = directivePrefix + "generate"
+	fieldDirective    = directivePrefix + "field"
+)
+
+// Directive is a //valctx:generate directive of a Go file, declaring a file generated
+// by valctx with the command line flags following the directive name:
+//
+//	//valctx:generate -output ctx.go -field UserID:string \
+//	//  -field Session:*.Session
+//
+// Flags are quoted like in the header of generated files, lines ending with a backslash
+// are continued by the next line comment.
+type Directive struct {
+	// Pos is the position of the directive, e.g. "ctx.go:3:1".
+	Pos  string
+	Args []string
+}
+
+// ReadDirectives returns the //valctx:generate directives of the Go source in their order.
+// The filename is used in directive positions.
+func ReadDirectives(filename string, src []byte) ([]Directive, error) {
+	if !bytes.Contains(src, []byte(generateDirective)) {
+		return nil, nil
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	var directives []Directive
+	for _, group := range file.Comments {
+		for i := 0; i < len(group.List); i++ {
+			c := group.List[i]
+			if !isDirective(c.Text, generateDirective) {
+				continue
+			}
+			pos := fset.Position(c.Pos()).String()
+			line := strings.TrimPrefix(c.Text, generateDirective)
+			for strings.HasSuffix(line, "\\") && i+1 < len(group.List) && !strings.HasPrefix(group.List[i+1].Text, "/*") {
+				i++
+				line = strings.TrimSuffix(line, "\\") + " " + strings.TrimPrefix(group.List[i].Text, "//")
+			}
+			args, err := splitArgs(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid directive: %v", pos, err)
+			}
+			directives = append(directives, Directive{Pos: pos, Args: args})
+		}
+	}
+	return directives, nil
+}
+
+// ReadFieldDirectives returns the fields declared with //valctx:field directives in the doc comments
+// of the type declarations of the Go source, in their order:
+//
+//	//valctx:field TenantID,set-once
+//	type Tenant string
+//
+// The field type is the declared type of the generated package, e.g. .Tenant.
+// The directive is followed by the field name, defaulting to the type name,
+// and the field options in the -field flag format. The filename is used in field positions.
+func ReadFieldDirectives(filename string, src []byte) ([]Field, error) {
+	if !bytes.Contains(src, []byte(fieldDirective)) {
+		return nil, nil
+	}
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	// The comment map associates the doc comments with the declarations following them.
+	nodes := map[*ast.CommentGroup]ast.Node{}
+	for node, groups := range ast.NewCommentMap(fset, file, file.Comments) {
+		for _, group := range groups {
+			nodes[group] = node
+		}
+	}
+	var fields []Field
+	for _, group := range file.Comments {
+		for _, c := range group.List {
+			if !isDirective(c.Text, fieldDirective) {
+				continue
+			}
+			pos := fset.Position(c.Pos()).String()
+			spec := documentedType(nodes[group], group)
+			if spec == nil {
+				return nil, fmt.Errorf("%s: %s directive must be in the doc comment of a type declaration", pos, fieldDirective)
+			}
+			f, err := parseFieldDirective(strings.TrimPrefix(c.Text, fieldDirective), spec.Name.Name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid field directive: %v", pos, err)
+			}
+			f.Pos = pos
+			fields = append(fields, f)
+		}
+	}
+	return fields, nil
+}
+
+// isDirective reports whether the comment is the directive with the given name.
+func isDirective(comment, directive string) bool {
+	return comment == directive || strings.HasPrefix(comment, directive+" ")
+}
+
+// documentedType returns the type declaration documented by the comment group associated with node.
+func documentedType(node ast.Node, doc *ast.CommentGroup) *ast.TypeSpec {
+	switch n := node.(type) {
+	case *ast.GenDecl:
+		if n.Tok == token.TYPE && n.Doc == doc && len(n.Specs) == 1 {
+			return n.Specs[0].(*ast.TypeSpec)
+		}
+	case *ast.TypeSpec:
+		if n.Doc == doc {
+			return n
+		}
+	}
+	return nil
+}
+
+// parseFieldDirective parses the field of a //valctx:field directive
+// in [name][,option[=value]]... format for the declared type.
+func parseFieldDirective(value, typeName string) (Field, error) {
+	value = strings.TrimSpace(value)
+	name, options := value, ""
+	if i := strings.Index(value, ","); i >= 0 {
+		name, options = value[:i], value[i:]
+	}
+	name = strings.TrimSpace(name)
+	if strings.Contains(name, ":") {
+		return Field{}, fmt.Errorf("field type is the declared type %s", typeName)
+	}
+	if name == "" {
+		name = typeName
+	}
+	return ParseField(name + ":." + typeName + options)
+}
+
+// scanFieldDirectives returns the fields of the //valctx:field directives of the package
+// in dir, except the output file. Test files and files excluded from the build are ignored.
+func scanFieldDirectives(dir, pkgName, output string) ([]Field, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var fields []Field
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") ||
+			filepath.Clean(path) == filepath.Clean(output) {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(token.NewFileSet(), path, src, parser.PackageClauseOnly)
+		if err != nil {
+			return nil, fmt.Errorf("parse package: %v", err)
+		}
+		if file.Name.Name != pkgName {
+			continue
+		}
+		found, err := ReadFieldDirectives(path, src)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, found...)
+	}
+	return fields, nil
+}
@@ -0,0 +1,172 @@
+package valctxgen
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Errors lists all the problems of an invalid spec: *SpecError, *FieldError,
+// *DuplicateFieldError, *FieldClashError, *UndeclaredTypeError and *CollisionError.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e Errors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// SpecError is a validation error of a Spec setting other than the fields.
+type SpecError struct {
+	// Setting is the name of the invalid Spec field, e.g. "GoVersion".
+	Setting string
+	Err     error
+}
+
+func (e *SpecError) Error() string {
+	return e.Err.Error()
+}
+
+// FieldError is a validation error of a field.
+type FieldError struct {
+	// Index is the index of the field in Spec.Fields.
+	Index int
+	Name  string
+	// Pos is the position of the field in a spec file, see Field.Pos.
+	Pos string
+	Err error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("invalid field %q: %v", e.Name, e.Err)
+}
+
+// DuplicateFieldError is reported for a field with the name, or the former name,
+// of another field.
+type DuplicateFieldError struct {
+	// Index is the index of the field in Spec.Fields.
+	Index int
+	Name  string
+	// Pos is the position of the field in a spec file, see Field.Pos.
+	Pos string
+}
+
+func (e *DuplicateFieldError) Error() string {
+	return fmt.Sprintf("field %q is duplicated", e.Name)
+}
+
+// FieldClashError is reported for a declaration generated for a field, which is also
+// generated for a previous field, e.g. SetUserLoader for a lazy User field and a UserLoader field.
+type FieldClashError struct {
+	// Index is the index of the field in Spec.Fields.
+	Index int
+	Name  string
+	// Pos is the position of the field in a spec file, see Field.Pos.
+	Pos string
+	// Decl is the name of the clashing declaration, e.g. "SetUserLoader".
+	Decl string
+	// Other is the name of the previous field.
+	Other string
+}
+
+func (e *FieldClashError) Error() string {
+	return fmt.Sprintf("%s of field %q is also generated for field %q", e.Decl, e.Name, e.Other)
+}
+
+// UndeclaredTypeError is reported with Spec.VerifyLocalTypes for a local type
+// not declared in the output package.
+type UndeclaredTypeError struct {
+	// Index is the index of the field in Spec.Fields.
+	Index int
+	Name  string
+	// Pos is the position of the field in a spec file, see Field.Pos.
+	Pos  string
+	Type string
+	// Dir is the directory of the output package.
+	Dir string
+}
+
+func (e *UndeclaredTypeError) Error() string {
+	return fmt.Sprintf("type %s of field %q is not declared in %s", e.Type, e.Name, e.Dir)
+}
+
+// CollisionError is reported for a declaration generated for a field, which is already
+// declared in another file of the output package.
+type CollisionError struct {
+	// Index is the index of the field in Spec.Fields.
+	Index int
+	Name  string
+	// Pos is the position of the field in a spec file, see Field.Pos.
+	Pos string
+	// Decl is the name of the colliding declaration, e.g. "GetUserID".
+	Decl string
+	// DeclPos is the position of the existing declaration.
+	DeclPos string
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("%s of field %q is already declared at %s", e.Decl, e.Name, e.DeclPos)
+}
+
+// UncheckedError is returned with the generated source if it couldn't be type-checked,
+// because the installed Go can't provide the standard packages. The source is still parsed.
+type UncheckedError struct {
+	Err error
+}
+
+func (e *UncheckedError) Error() string {
+	return fmt.Sprintf("generated code is not type-checked: %v", e.Err)
+}
+
+// Diagnostic is a machine-readable description of a problem of a spec.
+type Diagnostic struct {
+	// Setting is the invalid Spec setting, e.g. "GoVersion". It is empty for field problems.
+	Setting string `json:"setting,omitempty"`
+	// Index is the index of the invalid field in Spec.Fields, or -1 for setting problems.
+	Index int `json:"index"`
+	// Field is the name of the invalid field.
+	Field string `json:"field,omitempty"`
+	// Pos is the position of the invalid field in a spec file, if any.
+	Pos     string `json:"pos,omitempty"`
+	Message string `json:"message"`
+}
+
+// Diagnostics returns the diagnostics of err returned by Generate or WriteFiles.
+// Errors other than validation errors are returned as a diagnostic without a setting and index -1.
+func Diagnostics(err error) []Diagnostic {
+	if err == nil {
+		return nil
+	}
+	errs, ok := err.(Errors)
+	if !ok {
+		errs = Errors{err}
+	}
+	diags := make([]Diagnostic, 0, len(errs))
+	for _, err := range errs {
+		d := Diagnostic{Index: -1, Message: err.Error()}
+		switch e := err.(type) {
+		case *SpecError:
+			d.Setting = e.Setting
+		case *FieldError:
+			d.Index, d.Field, d.Pos = e.Index, e.Name, e.Pos
+		case *DuplicateFieldError:
+			d.Index, d.Field, d.Pos = e.Index, e.Name, e.Pos
+		case *FieldClashError:
+			d.Index, d.Field, d.Pos = e.Index, e.Name, e.Pos
+		case *UndeclaredTypeError:
+			d.Index, d.Field, d.Pos = e.Index, e.Name, e.Pos
+		case *CollisionError:
+			d.Index, d.Field, d.Pos = e.Index, e.Name, e.Pos
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
@@ -0,0 +1,353 @@
+package valctxgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/hightech-ninja/valctx/internal/gen"
+)
+
+// ErrInvalidFormat is reported for fields not following the name[:type][,option[=value]]... format.
+var ErrInvalidFormat = errors.New("invalid format")
+
+// Field options, passed after the field type and separated with commas:
+// name[:type][,option[=value]]... The option value may also be separated with colon.
+const (
+	// OptionRenamedFrom keeps accessors of the former field name working
+	// after a field is renamed. Value is the former field name.
+	OptionRenamedFrom = "renamed-from"
+	// OptionSetOnce forbids overriding a value already set in the context.
+	// Value is the setter behavior: "error" (default) or "panic".
+	OptionSetOnce = "set-once"
+	// OptionCopy makes accessors of slice, map and pointer fields work with shallow copies.
+	// Value is when the value is copied: "set", "get" or both if empty.
+	OptionCopy = "copy"
+	// OptionLazy makes the field value computed by a loader on first access.
+	OptionLazy = "lazy"
+	// OptionMutable makes the field value updatable in place by handlers deeper in the stack.
+	OptionMutable = "mutable"
+	// OptionAppend makes the field a list accumulated across context layers.
+	// The field type is the type of list elements.
+	OptionAppend = "append"
+	// OptionCloser makes the setter close the value, implementing io.Closer,
+	// when the context is done.
+	OptionCloser = "closer"
+	// OptionTTL allows to set the field value with a time-to-live.
+	OptionTTL = "ttl"
+	// OptionNilIsAbsent makes the getter report nil values as absent.
+	// Value is what the setter does with nil values: "get" keeps them (default),
+	// "drop" ignores them, "refuse" returns an error.
+	OptionNilIsAbsent = "nil-is-absent"
+	// OptionValidate makes the setter check the value with a validator function func(T) error.
+	// Value is the function in module/path.Func format, or Func for functions of the generated package.
+	OptionValidate = "validate"
+	// OptionHeader makes the generated FromHeader function set the field from an HTTP header.
+	// Value is the header name. The field type is string or a type of the generated package,
+	// whose string kind is not checked: a type of another kind fails the build of the package.
+	OptionHeader = "header"
+	// OptionRequired makes FromHeader fail if the header of the field is missing.
+	OptionRequired = "required"
+)
+
+// kindOptions replace the generated accessors entirely,
+// so they can't be combined with other options.
+var kindOptions = map[string]gen.Kind{
+	OptionLazy:    gen.KindLazy,
+	OptionMutable: gen.KindMutable,
+	OptionAppend:  gen.KindAppend,
+}
+
+var nilPolicies = map[string]gen.NilPolicy{
+	"":       gen.NilIsAbsent,
+	"get":    gen.NilIsAbsent,
+	"drop":   gen.NilDropped,
+	"refuse": gen.NilRefused,
+}
+
+// Option is a field option, see the Option constants.
+type Option struct {
+	Name  string
+	Value string
+}
+
+// ParseOption parses an option in name[=value] format.
+func ParseOption(value string) (Option, error) {
+	o := Option{Name: strings.TrimSpace(value)}
+	if i := strings.IndexAny(value, "=:"); i >= 0 {
+		o.Name = strings.TrimSpace(value[:i])
+		o.Value = strings.TrimSpace(value[i+1:])
+	}
+	return o, o.Validate()
+}
+
+func (o Option) String() string {
+	if o.Value == "" {
+		return o.Name
+	}
+	return o.Name + "=" + o.Value
+}
+
+func (o Option) Validate() error {
+	switch o.Name {
+	case "":
+		return errors.New("option name is required")
+	case OptionRenamedFrom, OptionValidate, OptionHeader:
+		if o.Value == "" {
+			return fmt.Errorf("option %q requires a value", o.Name)
+		}
+		return nil
+	case OptionSetOnce:
+		switch o.Value {
+		case "", "error", "panic":
+			return nil
+		default:
+			return fmt.Errorf("option %q: unsupported value %q", o.Name, o.Value)
+		}
+	case OptionNilIsAbsent:
+		if _, ok := nilPolicies[o.Value]; !ok {
+			return fmt.Errorf("option %q: unsupported value %q", o.Name, o.Value)
+		}
+		return nil
+	case OptionCopy:
+		switch o.Value {
+		case "", "set", "get":
+			return nil
+		default:
+			return fmt.Errorf("option %q: unsupported value %q", o.Name, o.Value)
+		}
+	case OptionLazy, OptionMutable, OptionAppend, OptionCloser, OptionTTL, OptionRequired:
+		if o.Value != "" {
+			return fmt.Errorf("option %q doesn't accept a value", o.Name)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown option %q", o.Name)
+	}
+}
+
+// Field is a context field to generate accessors for.
+type Field struct {
+	// Name is the field name used in the accessor names, its first letter is upper-cased.
+	Name string
+	// Type is the field type in go-code format, except that named types are qualified with
+	// import paths (module/path.Type) or a dot for types of the generated package (.Type).
+	// Empty type means interface{}.
+	Type    string
+	Options []Option
+	// Pos is the position of the field in a spec file, e.g. "ctx.go:12:3", reported in diagnostics.
+	// It is empty for fields passed with flags.
+	Pos string
+}
+
+// ParseField parses a field in name[:type][,option[=value]]... format, used by the -field flag.
+func ParseField(value string) (Field, error) {
+	var f Field
+	values := splitTopLevel(value, ',')
+	parts := strings.SplitN(values[0], ":", 2)
+	f.Name = fieldName(value)
+	if len(parts) == 2 {
+		f.Type = strings.TrimSpace(parts[1])
+		if f.Type == "" {
+			return Field{}, errors.New("type is required")
+		}
+	}
+	for _, v := range values[1:] {
+		o, err := ParseOption(v)
+		if err != nil {
+			return Field{}, err
+		}
+		f.Options = append(f.Options, o)
+	}
+
+	return f, f.Validate()
+}
+
+// fieldName returns the name of the field in the -field flag format.
+func fieldName(value string) string {
+	name := strings.SplitN(splitTopLevel(value, ',')[0], ":", 2)[0]
+	return modifyFirstLetter(strings.TrimSpace(name), strings.ToUpper)
+}
+
+// ParseFields parses fields in the -field flag format, see ParseField.
+// Invalid fields are reported with Errors of *FieldError, indexed in values.
+func ParseFields(values []string) ([]Field, error) {
+	fields, parseErrs := parseFields(values)
+	var errs Errors
+	for i := range values {
+		if err, ok := parseErrs[i]; ok {
+			errs = append(errs, &FieldError{Index: i, Name: fields[i].Name, Err: err})
+		}
+	}
+	if err := errs.orNil(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// parseFields parses fields in the -field flag format. The invalid ones are replaced
+// with fields having their name only, and their errors are returned by index.
+func parseFields(values []string) ([]Field, map[int]error) {
+	fields := make([]Field, len(values))
+	errs := map[int]error{}
+	for i, value := range values {
+		f, err := ParseField(value)
+		if err != nil {
+			f, errs[i] = Field{Name: fieldName(value)}, err
+		}
+		fields[i] = f
+	}
+	return fields, errs
+}
+
+func (f Field) String() string {
+	s := f.Name
+	if f.Type != "" {
+		s = fmt.Sprintf("%s:%s", f.Name, f.Type)
+	}
+	for _, o := range f.Options {
+		s += "," + o.String()
+	}
+	return s
+}
+
+// Option returns the option with the given name.
+func (f Field) Option(name string) (Option, bool) {
+	for _, o := range f.Options {
+		if o.Name == name {
+			return o, true
+		}
+	}
+	return Option{}, false
+}
+
+// Validate checks the field format and options.
+// The field type and the combination of options are checked by Generate.
+func (f Field) Validate() error {
+	if f.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, _, _, err := parseType(f.Type, nil); err != nil {
+		return err
+	}
+	seenOptions := map[string]struct{}{}
+	for _, o := range f.Options {
+		if _, seen := seenOptions[o.Name]; seen {
+			return fmt.Errorf("option %q is duplicated", o.Name)
+		}
+		seenOptions[o.Name] = struct{}{}
+		if err := o.Validate(); err != nil {
+			return err
+		}
+		if _, ok := kindOptions[o.Name]; ok && len(f.Options) > 1 {
+			return fmt.Errorf("option %q can't be combined with other options", o.Name)
+		}
+	}
+	return nil
+}
+
+// splitTopLevel splits s by sep, ignoring separators enclosed in brackets,
+// so that types like map[K]V or func(a, b int) stay intact.
+func splitTopLevel(s string, sep rune) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+	for i, r := range s {
+		switch r {
+		case '[', '(', '{':
+			depth++
+		case ']', ')', '}':
+			depth--
+		case sep:
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + len(string(sep))
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// parseType rewrites a field type in flag format, where named types are qualified
+// with import paths (module/path.Type) or a dot for types of the generated package (.Type),
+// to go-code. It returns the imported packages and the local types the type refers to.
+// Type arguments of generic types are rewritten the same way, e.g.
+// example.com/opt.Option[github.com/google/uuid.UUID] becomes opt.Option[uuid.UUID].
+// Packages are referred to with gen.PackageName, or with their name in importNames.
+func parseType(s string, importNames map[string]string) (typ string, pkgs, locals []string, err error) {
+	var (
+		out   bytes.Buffer
+		start = -1
+	)
+	seen := map[string]struct{}{}
+	// qualify rewrites a run of identifier and import path characters.
+	qualify := func(word string) error {
+		dot := strings.LastIndex(word, ".")
+		if dot == -1 {
+			out.WriteString(word)
+			return nil
+		}
+		path, name := word[:dot], word[dot+1:]
+		if name == "" || strings.Contains(name, "/") {
+			return ErrInvalidFormat
+		}
+		if path == "" {
+			locals = append(locals, name)
+			out.WriteString(name)
+			return nil
+		}
+		if _, ok := seen[path]; !ok {
+			seen[path] = struct{}{}
+			pkgs = append(pkgs, path)
+		}
+		pkgName, ok := importNames[path]
+		if !ok {
+			pkgName = gen.PackageName(path)
+		}
+		out.WriteString(pkgName + "." + name)
+		return nil
+	}
+	for i, r := range s {
+		if isTypePunct(r) {
+			if start >= 0 {
+				if err := qualify(s[start:i]); err != nil {
+					return "", nil, nil, err
+				}
+				start = -1
+			}
+			out.WriteRune(r)
+			continue
+		}
+		if start == -1 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		if err := qualify(s[start:]); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return out.String(), pkgs, locals, nil
+}
+
+// isTypePunct reports whether r separates identifiers and import paths in a type.
+func isTypePunct(r rune) bool {
+	return unicode.IsSpace(r) || strings.ContainsRune("[](){}*,;<", r)
+}
+
+func keyName(fieldName string) string {
+	return modifyFirstLetter(fieldName, strings.ToLower) + "Key"
+}
+
+func modifyFirstLetter(s string, modify func(string) string) string {
+	if s == "" {
+		return s
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	return modify(string(r)) + s[size:]
+}
@@ -0,0 +1,180 @@
+package valctxgen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hightech-ninja/valctx/internal/gen"
+)
+
+// MergeFields merges the added fields into the existing ones of a generated file.
+// An added field replaces the existing field with the same name if their types are the same,
+// fields with conflicting types are reported with Errors of *FieldError, indexed in added.
+// The merged fields are sorted by name, so that the result doesn't depend on the order of merges.
+func MergeFields(existing, added []Field) ([]Field, error) {
+	var errs Errors
+	merged := append([]Field(nil), existing...)
+	byName := map[string]int{}
+	for i, f := range merged {
+		byName[mergeKey(f.Name)] = i
+	}
+	for i, f := range added {
+		j, ok := byName[mergeKey(f.Name)]
+		switch {
+		case !ok:
+			byName[mergeKey(f.Name)] = len(merged)
+			merged = append(merged, f)
+		case normalizeType(merged[j].Type) != normalizeType(f.Type):
+			errs = append(errs, &FieldError{
+				Index: i,
+				Name:  f.Name,
+				Pos:   f.Pos,
+				Err:   fmt.Errorf("type %s conflicts with type %s of the existing field", displayType(f.Type), displayType(merged[j].Type)),
+			})
+		default:
+			merged[j] = f
+		}
+	}
+	if err := errs.orNil(); err != nil {
+		return nil, err
+	}
+	sort.Sort(fieldsByName(merged))
+	return merged, nil
+}
+
+func mergeKey(name string) string {
+	return modifyFirstLetter(name, strings.ToUpper)
+}
+
+// normalizeType returns the field type without spaces, empty type is interface{}.
+func normalizeType(typ string) string {
+	if typ == "" {
+		return "interface{}"
+	}
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, typ)
+}
+
+func displayType(typ string) string {
+	if typ == "" {
+		return "interface{}"
+	}
+	return typ
+}
+
+type fieldsByName []Field
+
+func (a fieldsByName) Len() int           { return len(a) }
+func (a fieldsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a fieldsByName) Less(i, j int) bool { return mergeKey(a[i].Name) < mergeKey(a[j].Name) }
+
+// ReadFields returns the fields of a file generated by valctx, found by parsing its accessors.
+// It is meant for files without the recorded command, see ReadArgs: the field kinds and
+// the ttl option are recovered, but other options are not.
+func ReadFields(src []byte) ([]Field, error) {
+	if _, err := ReadVersion(src); err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	imports := map[string]string{} // package name to import path
+	for _, spec := range file.Imports {
+		path, err := strconv.Unquote(spec.Path.Value)
+		if err != nil {
+			return nil, err
+		}
+		name := gen.PackageName(path)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = path
+	}
+	var names []string
+	funcs := map[string]*ast.FuncDecl{}
+	for _, decl := range file.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Recv != nil || fn.Type.Results == nil {
+			continue
+		}
+		if fn.Doc != nil && strings.Contains(fn.Doc.Text(), "Deprecated:") {
+			continue
+		}
+		funcs[fn.Name.Name] = fn
+		names = append(names, fn.Name.Name)
+	}
+
+	var fields []Field
+	for _, name := range names {
+		var (
+			f       Field
+			results = funcs[name].Type.Results.List
+		)
+		switch {
+		case strings.HasPrefix(name, "Get"):
+			f.Name = strings.TrimPrefix(name, "Get")
+			typ := results[0].Type
+			switch {
+			case funcs["Append"+f.Name] != nil:
+				f.Options = []Option{{Name: OptionAppend}}
+				if slice, ok := typ.(*ast.ArrayType); ok {
+					typ = slice.Elt
+				}
+			case len(results) == 3:
+				f.Options = []Option{{Name: OptionLazy}}
+			case funcs["Set"+f.Name+"WithTTL"] != nil:
+				f.Options = []Option{{Name: OptionTTL}}
+			}
+			f.Type = flagType(typ, imports)
+			if results[0].Names == nil && len(results) == 1 && f.Options == nil && f.Type == "interface{}" {
+				f.Type = ""
+			}
+		case strings.HasPrefix(name, "Load") && funcs["Init"+strings.TrimPrefix(name, "Load")] != nil:
+			f.Name = strings.TrimPrefix(name, "Load")
+			f.Options = []Option{{Name: OptionMutable}}
+			f.Type = flagType(results[0].Type, imports)
+		default:
+			continue
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// flagType prints the type in the -field flag format: named types are qualified
+// with import paths, or with a dot for the types of the generated package.
+func flagType(typ ast.Expr, imports map[string]string) string {
+	ast.Inspect(typ, func(n ast.Node) bool {
+		switch x := n.(type) {
+		case *ast.SelectorExpr:
+			if id, ok := x.X.(*ast.Ident); ok {
+				if path, ok := imports[id.Name]; ok {
+					id.Name = path
+				}
+			}
+			return false
+		case *ast.Ident:
+			if types.Universe.Lookup(x.Name) == nil {
+				x.Name = "." + x.Name
+			}
+		}
+		return true
+	})
+	var buf bytes.Buffer
+	_ = printer.Fprint(&buf, token.NewFileSet(), typ)
+	return buf.String()
+}
@@ -0,0 +1,3 @@
+package gen_test
+
+func SetTraceIDs() {}
@@ -0,0 +1,14 @@
+package gen
+
+//valctx:field TenantID,set-once,required,header=X-Tenant
+type Tenant string
+
+type (
+	// Session is the session of the user.
+	//
+	//valctx:field
+	Session struct{}
+
+	// Locale is not a field.
+	Locale string
+)
@@ -0,0 +1,4 @@
+package gen
+
+//valctx:field
+type Fixture struct{}
@@ -0,0 +1,506 @@
+// Package valctxgen generates convenient setters and getters for context values.
+// It is the API behind the valctx command, for tools embedding the generator.
+package valctxgen
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hightech-ninja/valctx/internal/app"
+	"github.com/hightech-ninja/valctx/internal/gen"
+)
+
+// Spec describes a generated file.
+type Spec struct {
+	// Output is the path of the generated file. It is required by WriteFiles,
+	// and local types are verified in its directory.
+	Output string
+	// Package is the package name of the generated file. Defaults to the package declared
+	// by the Go files in the Output directory, or to the directory name.
+	Package string
+	// Version is the valctx version written to the header of the generated file.
+	Version string
+	// GoVersion is the Go version targeted by the generated code, e.g. "1.21".
+	// Defaults to 1.7.
+	GoVersion string
+	// NilIsAbsent is the nil-is-absent option value applied to fields of nilable types
+	// without the option. Empty string disables it.
+	NilIsAbsent string
+	// RuntimeKeys makes fields without kind options wrappers over valctx.Key.
+	RuntimeKeys bool
+	// VerifyLocalTypes checks that local field types are declared in the Output directory.
+	VerifyLocalTypes bool
+	// ScanFields adds the fields declared with //valctx:field directives by the Go files
+	// of the Output package to Fields, see ReadFieldDirectives. Errors of the scanned fields
+	// are indexed after Fields.
+	ScanFields bool
+	Fields     []Field
+	// RawFields are fields in the -field flag format, see ParseField, following Fields.
+	// Generate parses them and reports the invalid ones with *FieldError, indexed after Fields,
+	// together with the other problems of the spec.
+	RawFields []string
+
+	// parsed are the parsed RawFields.
+	parsed []Field
+	// parseErrs are the errors of the invalid RawFields by their index in fields.
+	parseErrs map[int]error
+	// scanned are the fields found by ScanFields.
+	scanned []Field
+}
+
+// Validate checks the settings of the spec, but not the fields themselves.
+// It returns Errors of *SpecError.
+func (s *Spec) Validate() error {
+	var errs Errors
+	if s.Package == "" {
+		errs = append(errs, &SpecError{Setting: "Package", Err: errors.New("package name is required")})
+	}
+	if len(s.Fields) == 0 && len(s.RawFields) == 0 && !s.ScanFields {
+		errs = append(errs, &SpecError{Setting: "Fields", Err: errors.New("at least one field is required")})
+	}
+	if s.GoVersion != "" {
+		if _, err := gen.ParseGoVersion(s.GoVersion); err != nil {
+			errs = append(errs, &SpecError{Setting: "GoVersion", Err: err})
+		}
+	}
+	if s.NilIsAbsent != "" {
+		if _, ok := nilPolicies[s.NilIsAbsent]; !ok {
+			errs = append(errs, &SpecError{Setting: "NilIsAbsent", Err: fmt.Errorf("unsupported nil-is-absent value %q", s.NilIsAbsent)})
+		}
+	}
+	return errs.orNil()
+}
+
+// Generate returns the formatted source of the file described by the spec.
+// Invalid specs are reported with Errors listing all the problems found.
+// The source is parsed and type-checked before it is returned, with stubs
+// for the imported non-standard packages and the types of the output package.
+// With Output set, declarations already declared by other files of the output package
+// are reported with *CollisionError.
+// If the installed Go can't provide the standard packages, the source isn't type-checked
+// and it is returned with *UncheckedError, which callers may report as a warning.
+func Generate(ctx context.Context, spec Spec) ([]byte, error) {
+	genPkg, genFields, err := spec.compile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = gen.Generate(ctx, &buf, genPkg, genFields); err != nil {
+		return nil, err
+	}
+	filename := filepath.Base(spec.Output)
+	if spec.Output == "" {
+		filename = spec.Package + ".go"
+	}
+	var unchecked error
+	if err = gen.Check(filename, buf.Bytes(), genPkg, genFields); err != nil {
+		if _, ok := err.(*gen.StdImportError); !ok {
+			return nil, err
+		}
+		unchecked = &UncheckedError{Err: err}
+	}
+	if spec.Output != "" {
+		if err = spec.checkCollisions(ctx, genPkg, genFields); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), unchecked
+}
+
+// WriteFiles generates the files described by the specs and writes them to their outputs.
+// A file is replaced only if it is generated successfully. WriteFiles stops at the first error,
+// except *UncheckedError: unchecked files are written, and the first one is returned at the end.
+func WriteFiles(ctx context.Context, specs ...Spec) error {
+	var unchecked error
+	for _, spec := range specs {
+		if spec.Output == "" {
+			return Errors{&SpecError{Setting: "Output", Err: errors.New("output file is required")}}
+		}
+		src, err := Generate(ctx, spec)
+		if _, ok := err.(*UncheckedError); ok && unchecked == nil {
+			unchecked = err
+		} else if err != nil && !ok {
+			return err
+		}
+		if err = writeFile(spec.Output, src); err != nil {
+			return fmt.Errorf("write %s: %v", spec.Output, err)
+		}
+	}
+	return unchecked
+}
+
+func writeFile(output string, src []byte) (err error) {
+	file, err := app.NewSafeFile(output)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err = file.Write(src); err != nil {
+		return err
+	}
+	file.(*app.SafeFile).WithRename()
+	return nil
+}
+
+// compile validates the spec and converts it to the generator input.
+// Invalid fields are skipped, so that the problems of all fields are reported.
+func (s *Spec) compile(ctx context.Context) (gen.Package, []gen.Field, error) {
+	var errs Errors
+	if err := s.resolvePackage(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := s.Validate(); err != nil {
+		errs = append(errs, err.(Errors)...)
+	}
+	var goVer gen.GoVersion
+	if s.GoVersion != "" {
+		goVer, _ = gen.ParseGoVersion(s.GoVersion)
+	}
+	var declared map[string]struct{}
+	dir := filepath.Dir(s.Output)
+	if s.ScanFields {
+		if err := s.scanFields(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s.VerifyLocalTypes {
+		var err error
+		if declared, err = declaredTypes(dir); err != nil {
+			errs = append(errs, &SpecError{Setting: "Output", Err: err})
+		}
+	}
+	s.parseRawFields()
+	fields := s.fields()
+	genFields := make([]gen.Field, 0, len(fields))
+	compiled := make([]int, 0, len(fields)) // indexes of genFields in fields
+	seenFields := map[string]struct{}{}
+	seenPkgs := map[string]struct{}{
+		"context": {},
+	}
+	for i, f := range fields {
+		field, imports, err := s.compileField(f, goVer, nil)
+		if parseErr, ok := s.parseErrs[i]; ok {
+			err = parseErr
+		}
+		if err != nil {
+			errs = append(errs, &FieldError{Index: i, Name: field.FieldName, Pos: f.Pos, Err: err})
+			// The invalid field still takes its name, so that its duplicates are reported.
+			if field.FieldName != "" {
+				seenFields[field.FieldName] = struct{}{}
+			}
+			continue
+		}
+		valid := true
+		for _, name := range []string{field.FieldName, field.OldFieldName} {
+			if name == "" {
+				continue
+			}
+			_, seen := seenFields[name]
+			if seen {
+				errs = append(errs, &DuplicateFieldError{Index: i, Name: name, Pos: f.Pos})
+				valid = false
+			}
+			seenFields[name] = struct{}{}
+		}
+		if declared != nil {
+			for _, typ := range field.LocalTypes() {
+				if _, ok := declared[typ]; !ok {
+					errs = append(errs, &UndeclaredTypeError{Index: i, Name: field.FieldName, Type: typ, Dir: dir, Pos: f.Pos})
+					valid = false
+				}
+			}
+		}
+		if !valid {
+			continue
+		}
+		for _, imp := range imports {
+			seenPkgs[imp] = struct{}{}
+		}
+		genFields = append(genFields, field)
+		compiled = append(compiled, i)
+	}
+
+	genPkg := gen.Package{
+		PackageName: s.Package,
+		Version:     s.Version,
+		GoVersion:   goVer,
+		Command:     s.commandLines(),
+	}
+	toImport := make([]string, 0, len(seenPkgs))
+	for imp := range seenPkgs {
+		toImport = append(toImport, imp)
+	}
+	sort.Sort(sort.StringSlice(toImport))
+	genPkg.ImportPackages = toImport
+	if genPkg.ImportNames = gen.ImportNames(toImport); len(genPkg.ImportNames) > 0 {
+		// Refer to the renamed packages in the field types and validators.
+		for j, i := range compiled {
+			genFields[j], _, _ = s.compileField(fields[i], goVer, genPkg.ImportNames)
+		}
+	}
+	if s.Package != "" {
+		if err := genPkg.Validate(); err != nil {
+			errs = append(errs, &SpecError{Setting: "Package", Err: err})
+		}
+	}
+	if err := errs.orNil(); err != nil {
+		return gen.Package{}, nil, err
+	}
+	if err := checkFieldClashes(ctx, genPkg, genFields, fields); err != nil {
+		return gen.Package{}, nil, err
+	}
+	return genPkg, genFields, nil
+}
+
+// scanFields finds the fields of the //valctx:field directives of the Output package.
+func (s *Spec) scanFields() error {
+	switch {
+	case s.Output == "":
+		return &SpecError{Setting: "ScanFields", Err: errors.New("output file is required to scan fields")}
+	case s.Package == "":
+		return nil // reported by Validate
+	}
+	dir := filepath.Dir(s.Output)
+	scanned, err := scanFieldDirectives(dir, s.Package, s.Output)
+	if err != nil {
+		return &SpecError{Setting: "ScanFields", Err: err}
+	}
+	if len(s.Fields) == 0 && len(s.RawFields) == 0 && len(scanned) == 0 {
+		return &SpecError{Setting: "Fields", Err: fmt.Errorf("at least one field is required, no %s directives found in %s", fieldDirective, dir)}
+	}
+	s.scanned = scanned
+	return nil
+}
+
+// parseRawFields parses the RawFields. The invalid ones are replaced with fields
+// having their name only, and their errors are kept in parseErrs.
+func (s *Spec) parseRawFields() {
+	parsed, errs := parseFields(s.RawFields)
+	s.parsed, s.parseErrs = parsed, map[int]error{}
+	for i, err := range errs {
+		s.parseErrs[len(s.Fields)+i] = err
+	}
+}
+
+// fields returns the fields of the spec followed by the parsed RawFields and the scanned fields.
+func (s *Spec) fields() []Field {
+	fields := append(s.Fields[:len(s.Fields):len(s.Fields)], s.parsed...)
+	return append(fields, s.scanned...)
+}
+
+// compileField converts the field to the generator input.
+// It returns the packages imported by the field accessors.
+// Packages are referred to with gen.PackageName, or with their name in importNames.
+func (s *Spec) compileField(f Field, goVer gen.GoVersion, importNames map[string]string) (gen.Field, []string, error) {
+	name := modifyFirstLetter(f.Name, strings.ToUpper)
+	field := gen.Field{
+		FieldName: name,
+		KeyName:   keyName(name),
+	}
+	if err := f.Validate(); err != nil {
+		return field, nil, err
+	}
+	var imports []string
+	field.SetGoVersion(goVer)
+	if o, ok := f.Option(OptionRenamedFrom); ok {
+		field.OldFieldName = modifyFirstLetter(o.Value, strings.ToUpper)
+		field.OldKeyName = keyName(field.OldFieldName)
+	}
+	for _, o := range f.Options {
+		if kind, ok := kindOptions[o.Name]; ok {
+			field.Kind = kind
+		}
+	}
+	if s.RuntimeKeys && field.Kind == gen.KindValue {
+		field.Kind = gen.KindKey
+	}
+	if o, ok := f.Option(OptionSetOnce); ok {
+		field.SetOnce = gen.SetOnceError
+		if o.Value == "panic" {
+			field.SetOnce = gen.SetOncePanic
+		}
+	}
+	if o, ok := f.Option(OptionCopy); ok {
+		switch o.Value {
+		case "set":
+			field.Copy = gen.CopyOnSet
+		case "get":
+			field.Copy = gen.CopyOnGet
+		default:
+			field.Copy = gen.CopyAlways
+		}
+	}
+	_, field.Closer = f.Option(OptionCloser)
+	_, field.TTL = f.Option(OptionTTL)
+	if f.Type == "" {
+		field.FieldType = "interface{}"
+		if goVer.AtLeast(1, 18) {
+			field.FieldType = "any"
+		}
+	} else {
+		typ, pkgs, locals, _ := parseType(f.Type, importNames)
+		imports = append(imports, pkgs...)
+		field.FieldType = typ
+		field.SetPackages(pkgs...)
+		field.SetLocalTypes(locals...)
+		field.SetImportNames(importNames)
+	}
+	if o, ok := f.Option(OptionValidate); ok {
+		field.Validator = o.Value
+		if dot := strings.LastIndex(o.Value, "."); dot >= 0 {
+			pkgName := o.Value[:dot]
+			imports = append(imports, pkgName)
+			field.SetValidatorPackage(pkgName)
+			name, ok := importNames[pkgName]
+			if !ok {
+				name = gen.PackageName(pkgName)
+			}
+			field.Validator = name + o.Value[dot:]
+		}
+	}
+	if o, ok := f.Option(OptionHeader); ok {
+		field.Header = o.Value
+	}
+	_, field.HeaderRequired = f.Option(OptionRequired)
+	if o, ok := f.Option(OptionNilIsAbsent); ok {
+		field.Nil = nilPolicies[o.Value]
+	} else if _, ok := nilPolicies[s.NilIsAbsent]; ok && s.NilIsAbsent != "" &&
+		field.Kind == gen.KindValue && field.NilKind() != "" {
+		field.Nil = nilPolicies[s.NilIsAbsent]
+		if field.Closer {
+			field.Nil = gen.NilIsAbsent
+		}
+	}
+
+	if err := field.Validate(); err != nil {
+		return field, nil, err
+	}
+	return field, append(imports, field.Imports()...), nil
+}
+
+// resolvePackage infers the package name from the Output directory if it is not set,
+// or checks that it is the package declared in the directory.
+func (s *Spec) resolvePackage() error {
+	if s.Output == "" {
+		return nil
+	}
+	dir := filepath.Dir(s.Output)
+	declared, err := declaredPackage(dir, s.Output)
+	if err != nil {
+		return &SpecError{Setting: "Package", Err: err}
+	}
+	switch {
+	case declared != "" && s.Package == "":
+		s.Package = declared
+	case declared != "" && s.Package != declared:
+		return &SpecError{Setting: "Package", Err: fmt.Errorf("package %s conflicts with package %s declared in %s", s.Package, declared, dir)}
+	case s.Package == "":
+		if s.Package = dirPackageName(dir); s.Package == "" {
+			return &SpecError{Setting: "Package", Err: fmt.Errorf("can't infer package name from directory %s", dir)}
+		}
+	}
+	return nil
+}
+
+// declaredPackage returns the package declared by the non-test Go files in dir,
+// except the output file, or empty string if there are no such files.
+func declaredPackage(dir, output string) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	pkgs := map[string]struct{}{}
+	fset := token.NewFileSet()
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(dir, name)
+		if info.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") ||
+			filepath.Clean(path) == filepath.Clean(output) {
+			continue
+		}
+		if ok, err := build.Default.MatchFile(dir, name); err != nil || !ok {
+			continue
+		}
+		file, err := parser.ParseFile(fset, path, nil, parser.PackageClauseOnly)
+		if err != nil {
+			return "", fmt.Errorf("parse package: %v", err)
+		}
+		pkgs[file.Name.Name] = struct{}{}
+	}
+	names := make([]string, 0, len(pkgs))
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Sort(sort.StringSlice(names))
+	switch len(names) {
+	case 0:
+		return "", nil
+	case 1:
+		return names[0], nil
+	}
+	return "", fmt.Errorf("multiple packages in %s: %s", dir, strings.Join(names, ", "))
+}
+
+// dirPackageName returns the name of the directory made an identifier: lower-cased,
+// without characters not allowed in identifiers, e.g. go-redis becomes goredis.
+func dirPackageName(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, filepath.Base(abs))
+	if name == "" || unicode.IsDigit([]rune(name)[0]) || token.Lookup(name).IsKeyword() {
+		return ""
+	}
+	return name
+}
+
+// declaredTypes returns the types declared in the package in dir, ignoring test files.
+func declaredTypes(dir string) (map[string]struct{}, error) {
+	declared := map[string]struct{}{}
+	fset := token.NewFileSet()
+	notTest := func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}
+	pkgs, err := parser.ParseDir(fset, dir, notTest, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("parse package: %v", err)
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gd, ok := decl.(*ast.GenDecl)
+				if !ok || gd.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gd.Specs {
+					declared[spec.(*ast.TypeSpec).Name.Name] = struct{}{}
+				}
+			}
+		}
+	}
+	return declared, nil
+}
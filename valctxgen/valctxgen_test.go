@@ -0,0 +1,518 @@
+package valctxgen
+
+import (
+	"bytes"
+	"context"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseField(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "userID", want: "UserID"},
+		{value: "TraceIDs:[]string", want: "TraceIDs:[]string"},
+		{value: "Attrs:map[string, int],copy:get, set-once", want: "Attrs:map[string, int],copy=get,set-once"},
+		{value: "Value:example.com/opt.Option[string]", want: "Value:example.com/opt.Option[string]"},
+		{value: "UserID:", wantErr: true},
+		{value: "UserID:a.b/c", wantErr: true},
+		{value: "UserID,undefined", wantErr: true},
+		{value: "UserID,ttl,ttl", wantErr: true},
+	} {
+		f, err := ParseField(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseField(%q) err = %v, want error: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got := f.String(); err == nil && got != tt.want {
+			t.Errorf("ParseField(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateGoVersion(t *testing.T) {
+	fields := []Field{{Name: "UserID", Type: "string"}}
+	for _, tt := range []struct {
+		version string
+		wantErr string
+	}{
+		{version: "1.21"},
+		{version: "1.21.3"},
+		{version: "1.21rc1"},
+		{version: "1.22beta2"},
+		{version: "go1.22.0"},
+		{version: "go1.21rc1"},
+		{version: "1", wantErr: `invalid go version "1": no minor version, want 1.N, 1.N.P, 1.NrcR or 1.NbetaR`},
+		{version: "1.21.x", wantErr: `invalid go version "1.21.x": bad patch version "x", want 1.N, 1.N.P, 1.NrcR or 1.NbetaR`},
+		{version: "1.21rc", wantErr: `invalid go version "1.21rc": bad pre-release "rc", want 1.N, 1.N.P, 1.NrcR or 1.NbetaR`},
+		{version: "1.+21", wantErr: `invalid go version "1.+21": bad minor version "+21", want 1.N, 1.N.P, 1.NrcR or 1.NbetaR`},
+		{version: "2.0", wantErr: "go version must be 1.7 or later"},
+	} {
+		_, err := Generate(context.Background(), Spec{Package: "gen", GoVersion: tt.version, Fields: fields})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("GoVersion %q: Generate() err = %v", tt.version, err)
+			}
+			continue
+		}
+		if errs, ok := err.(Errors); !ok || len(errs) != 1 || errs[0].Error() != tt.wantErr {
+			t.Errorf("GoVersion %q: Generate() err = %v, want %s", tt.version, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	fields := []Field{{Name: "UserID", Type: "string"}}
+	for _, tt := range []struct {
+		name  string
+		spec  Spec
+		check func(error) bool
+	}{
+		{
+			name: "spec error",
+			spec: Spec{Package: "gen", GoVersion: "1.6", Fields: fields},
+			check: func(err error) bool {
+				e, ok := err.(*SpecError)
+				return ok && e.Setting == "GoVersion"
+			},
+		},
+		{
+			name: "field error",
+			spec: Spec{Package: "gen", Fields: append(fields, Field{Name: "Count", Type: "int", Options: []Option{{Name: OptionCopy}}})},
+			check: func(err error) bool {
+				e, ok := err.(*FieldError)
+				return ok && e.Index == 1 && e.Name == "Count"
+			},
+		},
+		{
+			name: "duplicate field error",
+			spec: Spec{Package: "gen", Fields: append(fields, Field{Name: "userID"})},
+			check: func(err error) bool {
+				e, ok := err.(*DuplicateFieldError)
+				return ok && e.Index == 1 && e.Name == "UserID"
+			},
+		},
+		{
+			name: "undeclared type error",
+			spec: Spec{
+				Output:           filepath.Join("testdata", "missing", "ctx.go"),
+				Package:          "gen",
+				VerifyLocalTypes: true,
+				Fields:           []Field{{Name: "Session", Type: "*.Session"}},
+			},
+			check: func(err error) bool {
+				e, ok := err.(*UndeclaredTypeError)
+				return ok && e.Index == 0 && e.Type == "Session"
+			},
+		},
+	} {
+		_, err := Generate(context.Background(), tt.spec)
+		if errs, ok := err.(Errors); !ok || len(errs) != 1 || !tt.check(errs[0]) {
+			t.Errorf("%s: Generate() err = %#v", tt.name, err)
+		}
+	}
+}
+
+func TestGenerateAllErrors(t *testing.T) {
+	spec := Spec{
+		Package:   "gen",
+		GoVersion: "1.6",
+		Fields: []Field{
+			{Name: "UserID", Type: "string"},
+			{Name: "Count", Type: "int", Options: []Option{{Name: OptionCopy}}},
+			{Name: "UserID", Type: "int"},
+			{Name: "User", Type: "example.com/user.user", Pos: "ctx.go:3:1"},
+			{Name: "Count", Type: "[]int"},
+		},
+	}
+	_, err := Generate(context.Background(), spec)
+	want := []Diagnostic{
+		{Setting: "GoVersion", Index: -1, Message: "go version must be 1.7 or later"},
+		{Index: 1, Field: "Count", Message: `invalid field "Count": copy requires a slice, map or pointer type`},
+		{Index: 2, Field: "UserID", Message: `field "UserID" is duplicated`},
+		{Index: 3, Field: "User", Pos: "ctx.go:3:1", Message: `invalid field "User": invalid type`},
+		{Index: 4, Field: "Count", Message: `field "Count" is duplicated`},
+	}
+	got := Diagnostics(err)
+	if len(got) != len(want) {
+		t.Fatalf("Diagnostics() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Diagnostics()[%d] = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestGenerateRawFields(t *testing.T) {
+	spec := Spec{
+		Package:   "gen",
+		Fields:    []Field{{Name: "UserID", Type: "string"}},
+		RawFields: []string{"traceIDs:[]string, copy", "tenantID:string,bogus", "TenantID:string"},
+	}
+	_, err := Generate(context.Background(), spec)
+	want := []Diagnostic{
+		{Index: 2, Field: "TenantID", Message: `invalid field "TenantID": unknown option "bogus"`},
+		{Index: 3, Field: "TenantID", Message: `field "TenantID" is duplicated`},
+	}
+	if got := Diagnostics(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diagnostics() = %+v, want %+v", got, want)
+	}
+
+	spec.RawFields = spec.RawFields[:1]
+	if _, err = Generate(context.Background(), spec); err != nil {
+		t.Fatalf("Generate() err = %v", err)
+	}
+	want2 := []string{"-package", "gen", "-field", "UserID:string", "-field", "TraceIDs:[]string,copy"}
+	if got := spec.Args(); !reflect.DeepEqual(got, want2) {
+		t.Errorf("Args() = %q, want %q", got, want2)
+	}
+	if _, err = ParseFields([]string{"A", "B,bogus"}); !reflect.DeepEqual(Diagnostics(err), []Diagnostic{
+		{Index: 1, Field: "B", Message: `invalid field "B": unknown option "bogus"`},
+	}) {
+		t.Errorf("ParseFields() err = %v", err)
+	}
+}
+
+func TestGenerateChecksSource(t *testing.T) {
+	valid := Spec{
+		Package:   "gen",
+		GoVersion: "1.18",
+		Fields: []Field{
+			{Name: "Values", Type: "example.com/opt.Option[.Set[string]]"},
+			{Name: "Conn", Type: "*example.com/db.Conn", Options: []Option{{Name: OptionCloser}}},
+			{Name: "TenantID", Type: "string", Options: []Option{{Name: OptionValidate, Value: "example.com/tenant.Validate"}}},
+		},
+	}
+	if _, err := Generate(context.Background(), valid); err != nil {
+		t.Errorf("Generate() err = %v", err)
+	}
+
+	invalid := Spec{
+		Output:  filepath.Join("gen", "ctx.go"),
+		Package: "gen",
+		Fields:  []Field{{Name: "Tx", Type: "*database/sql.Tx", Options: []Option{{Name: OptionCloser}}}},
+	}
+	_, err := Generate(context.Background(), invalid)
+	if err == nil || !strings.HasPrefix(err.Error(), "generated code is invalid: ctx.go:") {
+		t.Errorf("Generate() err = %v, want invalid generated code", err)
+	}
+}
+
+func TestGenerateFormatted(t *testing.T) {
+	spec := Spec{
+		Package: "gen",
+		Fields: []Field{
+			{Name: "User", Type: "*example.com/user.User", Options: []Option{{Name: OptionLazy}}},
+			{Name: "Token", Type: "string", Options: []Option{{Name: OptionTTL}}},
+			{Name: "Account", Type: "example.com/account.Account"},
+			{Name: "Route", Type: "string", Options: []Option{{Name: OptionMutable}}},
+		},
+	}
+	want, err := Generate(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Generate() err = %v", err)
+	}
+	imports := "import (\n\t\"context\"\n\t\"sync\"\n\t\"time\"\n\n\t\"example.com/account\"\n\t\"example.com/user\"\n)\n"
+	if !bytes.Contains(want, []byte(imports)) {
+		t.Errorf("Generate() = %s, want imports %s", want, imports)
+	}
+	if formatted, err := format.Source(want); err != nil || !bytes.Equal(formatted, want) {
+		t.Errorf("Generate() = %s, want formatted source", want)
+	}
+	for i := 0; i < 10; i++ {
+		got, err := Generate(context.Background(), spec)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("Generate() = %s, %v, want %s", got, err, want)
+		}
+	}
+}
+
+func TestReadArgs(t *testing.T) {
+	spec := Spec{
+		Package:     "gen",
+		GoVersion:   "1.21",
+		NilIsAbsent: "drop",
+		Fields: []Field{
+			{Name: "UserID"},
+			{Name: "Attrs", Type: "map[string]int", Options: []Option{{Name: OptionCopy, Value: "get"}}},
+			{Name: "Events", Type: "chan<- *.Event"},
+		},
+	}
+	src, err := Generate(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadArgs(src)
+	if err != nil {
+		t.Fatalf("ReadArgs() err = %v", err)
+	}
+	if want := spec.Args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadArgs() = %q, want %q", got, want)
+	}
+
+	if args, err := splitArgs(quoteArg("it's") + " " + quoteArg("")); err != nil || !reflect.DeepEqual(args, []string{"it's", ""}) {
+		t.Errorf("splitArgs() = %q, %v, want quoted arguments", args, err)
+	}
+	if _, err = ReadArgs([]byte("package gen\n")); err != ErrNotGenerated {
+		t.Errorf("ReadArgs() err = %v, want ErrNotGenerated", err)
+	}
+	old := "// Code generated by valctx v0.0.1. DO NOT EDIT.\n\npackage gen\n"
+	if _, err = ReadArgs([]byte(old)); err != ErrNoCommand {
+		t.Errorf("ReadArgs() err = %v, want ErrNoCommand", err)
+	}
+}
+
+func TestReadDirectives(t *testing.T) {
+	src := `package gen
+
+//valctx:generate -output ctx.go -field UserID:string \
+//  -field 'Session:*.Session'
+
+// valctx:generate is not a directive.
+//valctx:generated is not a directive.
+
+func f() {
+	//valctx:generate -output=other.go -field Data
+}
+`
+	got, err := ReadDirectives("gen.go", []byte(src))
+	if err != nil {
+		t.Fatalf("ReadDirectives() err = %v", err)
+	}
+	want := []Directive{
+		{Pos: "gen.go:3:1", Args: []string{"-output", "ctx.go", "-field", "UserID:string", "-field", "Session:*.Session"}},
+		{Pos: "gen.go:10:2", Args: []string{"-output=other.go", "-field", "Data"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadDirectives() = %q, want %q", got, want)
+	}
+	if _, err = ReadDirectives("gen.go", []byte("package gen\n\n//valctx:generate -field 'Data\n")); err == nil ||
+		!strings.Contains(err.Error(), "gen.go:3:1: invalid directive") {
+		t.Errorf("ReadDirectives() err = %v, want invalid directive", err)
+	}
+}
+
+func TestReadFieldDirectives(t *testing.T) {
+	src := `package gen
+
+//valctx:field TenantID, set-once ,validate=ValidateTenant
+type Tenant string
+
+type (
+	//valctx:field
+	Session struct{}
+)
+
+//valctx:field TenantID,required,header=X-Tenant
+type TenantID string
+`
+	got, err := ReadFieldDirectives("types.go", []byte(src))
+	if err != nil {
+		t.Fatalf("ReadFieldDirectives() err = %v", err)
+	}
+	want := []Field{
+		{Name: "TenantID", Type: ".Tenant", Options: []Option{{Name: OptionSetOnce}, {Name: OptionValidate, Value: "ValidateTenant"}}, Pos: "types.go:3:1"},
+		{Name: "Session", Type: ".Session", Pos: "types.go:7:2"},
+		{Name: "TenantID", Type: ".TenantID", Options: []Option{{Name: OptionRequired}, {Name: OptionHeader, Value: "X-Tenant"}}, Pos: "types.go:11:1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFieldDirectives() = %+v, want %+v", got, want)
+	}
+
+	for _, tt := range []struct {
+		src, wantErr string
+	}{
+		{"//valctx:field TenantID,header\ntype Tenant string\n", `types.go:3:1: invalid field directive: option "header" requires a value`},
+		{"//valctx:field TenantID,origin=X-Tenant\ntype Tenant string\n", `types.go:3:1: invalid field directive: unknown option "origin"`},
+		{"//valctx:field TenantID:string\ntype Tenant string\n", "types.go:3:1: invalid field directive: field type is the declared type Tenant"},
+		{"//valctx:field\nfunc Tenant() {}\n", "types.go:3:1: //valctx:field directive must be in the doc comment of a type declaration"},
+		{"//valctx:field\n\ntype Tenant string\n", "types.go:3:1: //valctx:field directive must be in the doc comment of a type declaration"},
+	} {
+		_, err = ReadFieldDirectives("types.go", []byte("package gen\n\n"+tt.src))
+		if err == nil || err.Error() != tt.wantErr {
+			t.Errorf("ReadFieldDirectives(%q) err = %v, want %s", tt.src, err, tt.wantErr)
+		}
+	}
+}
+
+func TestGenerateScanFields(t *testing.T) {
+	spec := Spec{
+		Output:     filepath.Join("testdata", "directives", "ctx.go"),
+		ScanFields: true,
+		Fields:     []Field{{Name: "UserID", Type: "string"}},
+	}
+	src, err := Generate(context.Background(), spec)
+	if err != nil {
+		t.Fatalf("Generate() err = %v", err)
+	}
+	for _, want := range []string{
+		"// valctx -package gen -scan-fields \\\n//   -field UserID:string\n",
+		"func SetTenantID(ctx context.Context, v Tenant) (context.Context, error) {",
+		"func GetSession(ctx context.Context) (Session, bool) {",
+		"func FromHeader(ctx context.Context, h http.Header) (context.Context, error) {",
+		"if next, err = SetTenantID(next, Tenant(v)); err != nil {",
+		"return ctx, ErrTenantIDHeaderMissing",
+	} {
+		if !bytes.Contains(src, []byte(want)) {
+			t.Errorf("Generate() = %s, want %q", src, want)
+		}
+	}
+	if bytes.Contains(src, []byte("Fixture")) {
+		t.Errorf("Generate() = %s, want test files ignored", src)
+	}
+
+	spec.Fields = []Field{{Name: "Session", Type: "string"}}
+	_, err = Generate(context.Background(), spec)
+	want := []Diagnostic{{Index: 2, Field: "Session", Pos: filepath.Join("testdata", "directives", "types.go") + ":9:2", Message: `field "Session" is duplicated`}}
+	if got := Diagnostics(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diagnostics() = %+v, want %+v", got, want)
+	}
+}
+
+func TestReadFields(t *testing.T) {
+	src, err := ioutil.ReadFile(filepath.Join("testdata", "legacy", "ctx.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadFields(src)
+	if err != nil {
+		t.Fatalf("ReadFields() err = %v", err)
+	}
+	want := []Field{
+		{Name: "UserID"},
+		{Name: "User", Type: "*github.com/user/pkg.User", Options: []Option{{Name: OptionLazy}}},
+		{Name: "Breadcrumbs", Type: "string", Options: []Option{{Name: OptionAppend}}},
+		{Name: "Route", Type: "string", Options: []Option{{Name: OptionMutable}}},
+		{Name: "Token", Type: "string", Options: []Option{{Name: OptionTTL}}},
+		{Name: "Cache", Type: "map[string][]*.Session"},
+		{Name: "TenantID", Type: "string"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadFields() = %+v, want %+v", got, want)
+	}
+	if _, err = ReadFields([]byte("package gen\n")); err != ErrNotGenerated {
+		t.Errorf("ReadFields() err = %v, want ErrNotGenerated", err)
+	}
+}
+
+func TestMergeFields(t *testing.T) {
+	existing := []Field{
+		{Name: "UserID", Type: "string"},
+		{Name: "Data"},
+		{Name: "Attrs", Type: "map[string]int"},
+	}
+	added := []Field{
+		{Name: "TraceIDs", Type: "[]string"},
+		{Name: "attrs", Type: "map[string] int", Options: []Option{{Name: OptionCopy}}},
+		{Name: "Data", Type: "interface{}"},
+	}
+	got, err := MergeFields(existing, added)
+	if err != nil {
+		t.Fatalf("MergeFields() err = %v", err)
+	}
+	want := []Field{added[1], added[2], added[0], existing[0]}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MergeFields() = %+v, want %+v", got, want)
+	}
+
+	_, err = MergeFields(existing, []Field{{Name: "TraceIDs"}, {Name: "UserID", Type: "int"}})
+	want2 := []Diagnostic{{Index: 1, Field: "UserID", Message: `invalid field "UserID": type int conflicts with type string of the existing field`}}
+	if got := Diagnostics(err); !reflect.DeepEqual(got, want2) {
+		t.Errorf("MergeFields() diagnostics = %+v, want %+v", got, want2)
+	}
+}
+
+func TestGenerateCollisions(t *testing.T) {
+	dir := filepath.Join("testdata", "collision")
+	spec := Spec{
+		Output:  filepath.Join(dir, "ctx.go"),
+		Package: "gen",
+		Fields: []Field{
+			{Name: "UserID", Type: "string"},
+			{Name: "TenantID", Type: "string", Pos: "spec.go:2:1"},
+			{Name: "TraceIDs", Type: "[]string"},
+		},
+	}
+	_, err := Generate(context.Background(), spec)
+	want := []Diagnostic{
+		{Index: 0, Field: "UserID", Message: `GetUserID of field "UserID" is already declared at ` + filepath.Join(dir, "user.go") + ":3:6"},
+		{Index: 1, Field: "TenantID", Pos: "spec.go:2:1", Message: `tenantIDKey of field "TenantID" is already declared at ` + filepath.Join(dir, "tenant.go") + ":5:6"},
+	}
+	if got := Diagnostics(err); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diagnostics() = %+v, want %+v", got, want)
+	}
+
+	spec.Output = filepath.Join(dir, "user.go")
+	if _, err = Generate(context.Background(), spec); Diagnostics(err)[0].Field != "TenantID" {
+		t.Errorf("Generate() err = %v, want the output file ignored", err)
+	}
+}
+
+func TestGeneratePackage(t *testing.T) {
+	spec := Spec{
+		Output: filepath.Join("testdata", "collision", "count.go"),
+		Fields: []Field{{Name: "Count", Type: "int"}},
+	}
+	src, err := Generate(context.Background(), spec)
+	if err != nil || !bytes.Contains(src, []byte("\npackage gen\n")) {
+		t.Errorf("Generate() = %s, %v, want package gen", src, err)
+	}
+
+	spec.Package = "other"
+	_, err = Generate(context.Background(), spec)
+	if diags := Diagnostics(err); len(diags) != 1 || diags[0].Setting != "Package" {
+		t.Errorf("Generate() err = %v, want package conflict", err)
+	}
+
+	spec.Package = ""
+	spec.Output = filepath.Join("testdata", "missing", "Go-Redis", "ctx.go")
+	src, err = Generate(context.Background(), spec)
+	if err != nil || !bytes.Contains(src, []byte("\npackage goredis\n")) {
+		t.Errorf("Generate() = %s, %v, want package goredis", src, err)
+	}
+}
+
+func TestWriteFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "valctxgen-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spec := Spec{
+		Output:  filepath.Join(dir, "gen", "ctx.go"),
+		Package: "gen",
+		Fields:  []Field{{Name: "UserID", Type: "string"}},
+	}
+	if err = WriteFiles(context.Background(), spec); err != nil {
+		t.Fatalf("WriteFiles() err = %v", err)
+	}
+	got, err := ioutil.ReadFile(spec.Output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Generate(context.Background(), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("WriteFiles() wrote %q, want %q", got, want)
+	}
+
+	spec.Fields = []Field{{Name: "UserID", Type: "string", Options: []Option{{Name: OptionCopy}}}}
+	if err = WriteFiles(context.Background(), spec); err == nil {
+		t.Fatal("WriteFiles() err = nil for invalid spec")
+	}
+	if got2, _ := ioutil.ReadFile(spec.Output); !bytes.Equal(got2, got) {
+		t.Error("WriteFiles() changed the file for invalid spec")
+	}
+}